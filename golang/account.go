@@ -0,0 +1,342 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// 削除を申請してから実際に消すまでの猶予。この間にログインすれば取り消せる
+	accountDeletionGracePeriod = 7 * 24 * time.Hour
+	accountPurgeInterval       = 10 * time.Minute
+	accountPurgeBatchSize      = 10
+)
+
+var (
+	accountSettingsTemplate = template.Must(template.ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("account.html")),
+	)
+)
+
+func getAccountSettings(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	accountSettingsTemplate.Execute(w, struct {
+		Me          User
+		CSRFToken   string
+		Flash       string
+		GracePeriod int
+	}{me, getCSRFToken(r), getFlash(w, r, "notice"), int(accountDeletionGracePeriod.Hours() / 24)})
+}
+
+type exportProfile struct {
+	ID          int       `json:"id"`
+	AccountName string    `json:"account_name"`
+	Email       string    `json:"email,omitempty"`
+	Role        string    `json:"role"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type exportPost struct {
+	ID         int       `json:"id"`
+	Body       string    `json:"body"`
+	Visibility int       `json:"visibility"`
+	Status     int       `json:"status"`
+	Images     []string  `json:"images"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type exportComment struct {
+	ID        int       `json:"id"`
+	PostID    int       `json:"post_id"`
+	ParentID  int       `json:"parent_id,omitempty"`
+	Comment   string    `json:"comment"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func writeZipJSON(zw *zip.Writer, name string, v interface{}) error {
+	f, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// 画像はディスクにあればそれを、なければ初期データのようにDBにある元画像を入れる
+func writeZipImage(zw *zip.Writer, img PostImage) error {
+	for _, dir := range []string{imageDir, privateImageDir} {
+		src, err := os.Open(postImageFilename(dir, img))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+
+		dst, err := zw.Create("images/" + postImageName(img))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(dst, src)
+		return err
+	}
+
+	if img.Position != 0 {
+		return nil
+	}
+	imgdata := []byte{}
+	err := db.Get(&imgdata, "SELECT `imgdata` FROM `posts` WHERE `id` = ?", img.PostID)
+	if err != nil || len(imgdata) == 0 {
+		return err
+	}
+	dst, err := zw.Create("images/" + postImageName(img))
+	if err != nil {
+		return err
+	}
+	_, err = dst.Write(imgdata)
+	return err
+}
+
+// プロフィール・投稿・コメントのJSONと、投稿した元画像をまとめたzipを返す
+func getAccountExport(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	posts := []Post{}
+	err := db.Select(&posts,
+		"SELECT `id`, `user_id`, `body`, `mime`, `visibility`, `status`, `created_at` FROM `posts` WHERE `user_id` = ? ORDER BY `created_at`", me.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	images, err := selectPostImages(posts)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	comments := []Comment{}
+	err = db.Select(&comments,
+		"SELECT `id`, `post_id`, `parent_id`, `comment`, `created_at` FROM `comments` WHERE `user_id` = ? ORDER BY `created_at`", me.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="iscogram-`+me.AccountName+`.zip"`)
+
+	// 書き始めた後はステータスを変えられないので、途中のエラーはログに残して打ち切る
+	zw := zip.NewWriter(w)
+	defer zw.Close()
+
+	profile := exportProfile{
+		ID:          me.ID,
+		AccountName: me.AccountName,
+		Email:       me.Email.String,
+		Role:        me.Role,
+		CreatedAt:   me.CreatedAt,
+	}
+	if err := writeZipJSON(zw, "profile.json", profile); err != nil {
+		log.Print(err)
+		return
+	}
+
+	exportPosts := make([]exportPost, 0, len(posts))
+	for _, p := range posts {
+		imgs := images[p.ID]
+		if len(imgs) == 0 {
+			imgs = []PostImage{{PostID: p.ID, Mime: p.Mime}}
+		}
+		names := make([]string, 0, len(imgs))
+		for _, img := range imgs {
+			names = append(names, "images/"+postImageName(img))
+		}
+		exportPosts = append(exportPosts, exportPost{
+			ID:         p.ID,
+			Body:       p.Body,
+			Visibility: p.Visibility,
+			Status:     p.Status,
+			Images:     names,
+			CreatedAt:  p.CreatedAt,
+		})
+		images[p.ID] = imgs
+	}
+	if err := writeZipJSON(zw, "posts.json", exportPosts); err != nil {
+		log.Print(err)
+		return
+	}
+
+	exportComments := make([]exportComment, 0, len(comments))
+	for _, c := range comments {
+		exportComments = append(exportComments, exportComment{
+			ID:        c.ID,
+			PostID:    c.PostID,
+			ParentID:  c.ParentID,
+			Comment:   c.Comment,
+			CreatedAt: c.CreatedAt,
+		})
+	}
+	if err := writeZipJSON(zw, "comments.json", exportComments); err != nil {
+		log.Print(err)
+		return
+	}
+
+	for _, p := range posts {
+		for _, img := range images[p.ID] {
+			if err := writeZipImage(zw, img); err != nil {
+				log.Print(err)
+				return
+			}
+		}
+	}
+}
+
+// パスワードを確認してから削除を予約し、ログアウトさせる
+func postAccountDelete(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if ok, _ := verifyPassword(me, r.FormValue("password")); !ok {
+		session := getSession(r)
+		session.Values["notice"] = "パスワードが間違っています"
+		if !me.HasPassword() {
+			session.Values["notice"] = "アカウントを削除するには、先にパスワードを設定してください"
+		}
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/settings/account", http.StatusFound)
+		return
+	}
+
+	now := time.Now()
+	_, err := db.Exec("UPDATE `users` SET `deletion_scheduled_at` = ? WHERE `id` = ?", now.Add(accountDeletionGracePeriod), me.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	if err := revokeAllSessions(me.ID); err != nil {
+		log.Print(err)
+		return
+	}
+
+	session := getSession(r)
+	delete(session.Values, "user_id")
+	session.Values["notice"] = "アカウントの削除を受け付けました。" +
+		now.Add(accountDeletionGracePeriod).Format("2006-01-02 15:04") + "までにログインすると取り消せます"
+	session.Save(r, w)
+
+	http.Redirect(w, r, "/login", http.StatusFound)
+}
+
+// 猶予期間中にログインしたら削除の予約を取り消す
+// 取り消したときはtrueを返す
+func cancelAccountDeletion(u User) bool {
+	if !u.DeletionScheduledAt.Valid {
+		return false
+	}
+	result, err := db.Exec("UPDATE `users` SET `deletion_scheduled_at` = NULL WHERE `id` = ? AND `deletion_scheduled_at` IS NOT NULL", u.ID)
+	if err != nil {
+		log.Print(err)
+		return false
+	}
+	invalidateUserCache(u.ID)
+	n, err := result.RowsAffected()
+	return err == nil && n == 1
+}
+
+// ユーザーに紐づくデータをすべて消す。途中で失敗しても、次の回にやり直せば最後まで消える
+// 投稿やコメントは、画像や返信、キャッシュもまとめて消すdeletePostとdeleteCommentで消す
+func purgeUser(userID int) error {
+	postIDs := []int{}
+	err := db.Select(&postIDs, "SELECT `id` FROM `posts` WHERE `user_id` = ?", userID)
+	if err != nil {
+		return err
+	}
+	for _, pid := range postIDs {
+		if err := deletePost(pid); err != nil {
+			return err
+		}
+	}
+
+	commentIDs := []int{}
+	err = db.Select(&commentIDs, "SELECT `id` FROM `comments` WHERE `user_id` = ?", userID)
+	if err != nil {
+		return err
+	}
+	for _, cid := range commentIDs {
+		if err := deleteComment(cid); err != nil {
+			return err
+		}
+	}
+
+	// 管理操作の履歴は監査のために残す
+	queries := []string{
+		"DELETE FROM `notifications` WHERE `user_id` = ? OR `actor_id` = ?",
+		"DELETE FROM `follows` WHERE `follower_id` = ? OR `followee_id` = ?",
+		"DELETE FROM `blocks` WHERE `blocker_id` = ? OR `blocked_id` = ?",
+		"DELETE FROM `mutes` WHERE `muter_id` = ? OR `muted_id` = ?",
+		"DELETE cp FROM `collection_posts` AS cp JOIN `collections` AS c ON (cp.collection_id=c.id) WHERE c.user_id = ?",
+		"DELETE FROM `collections` WHERE `user_id` = ?",
+		"DELETE FROM `reports` WHERE `reporter_id` = ? OR `target_user_id` = ?",
+		"DELETE FROM `recovery_codes` WHERE `user_id` = ?",
+		"DELETE FROM `password_resets` WHERE `user_id` = ?",
+		"DELETE FROM `user_sessions` WHERE `user_id` = ?",
+		"DELETE FROM `user_identities` WHERE `user_id` = ?",
+		"DELETE FROM `bans` WHERE `user_id` = ?",
+		"DELETE FROM `users` WHERE `id` = ?",
+	}
+	for _, query := range queries {
+		args := make([]interface{}, strings.Count(query, "?"))
+		for i := range args {
+			args[i] = userID
+		}
+		if _, err := db.Exec(query, args...); err != nil {
+			return err
+		}
+	}
+
+	invalidateUserCache(userID)
+	return nil
+}
+
+// 猶予期間の過ぎたアカウントを消す
+func purgeDeletedAccounts() error {
+	users := []User{}
+	err := db.Select(&users, "SELECT * FROM `users` WHERE `deletion_scheduled_at` <= ? LIMIT ?", time.Now(), accountPurgeBatchSize)
+	if err != nil {
+		return err
+	}
+
+	for _, u := range users {
+		if err := purgeUser(u.ID); err != nil {
+			return err
+		}
+		if err := clearLoginFailures(accountLoginThrottle, u.AccountName); err != nil {
+			log.Print(err)
+		}
+		log.Printf("purged account %d (%s)", u.ID, u.AccountName)
+	}
+	return nil
+}
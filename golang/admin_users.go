@@ -0,0 +1,218 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const adminUsersPerPage = 100
+
+// 管理画面のユーザー一覧の1行。BAN中なら有効なBANの内容も持つ
+// 初期データのようにbansに記録のないBANもあるので、BANの列はNULLになりうる
+type AdminUser struct {
+	ID          int            `db:"id"`
+	AccountName string         `db:"account_name"`
+	Role        string         `db:"role"`
+	DelFlg      int            `db:"del_flg"`
+	CreatedAt   time.Time      `db:"created_at"`
+	Reason      sql.NullString `db:"reason"`
+	AdminName   sql.NullString `db:"admin_name"`
+	ExpiresAt   sql.NullTime   `db:"expires_at"`
+	BannedAt    sql.NullTime   `db:"banned_at"`
+}
+
+func (u AdminUser) IsBanned() bool {
+	return u.DelFlg != 0
+}
+
+// BANできるのは一般ユーザーだけ
+func (u AdminUser) Bannable() bool {
+	return u.DelFlg == 0 && u.Role == roleUser
+}
+
+// 強制ログアウトできるのはBANされていないユーザー。管理者やモデレーターはロールを管理できる人だけが対象にできる
+func (u AdminUser) LogoutableBy(me User) bool {
+	return u.DelFlg == 0 && canForceLogout(me, u.Role)
+}
+
+func canForceLogout(me User, targetRole string) bool {
+	return targetRole == roleUser || me.Can(permManageRoles)
+}
+
+// 一覧の絞り込み条件。Status以外は空なら絞り込まない
+type adminUserFilter struct {
+	Query       string
+	Status      string
+	Role        string
+	CreatedFrom string
+	CreatedTo   string
+	MaxID       int
+}
+
+func parseAdminUserFilter(r *http.Request) (adminUserFilter, bool) {
+	q := r.URL.Query()
+	f := adminUserFilter{
+		Query:       q.Get("q"),
+		Status:      q.Get("status"),
+		Role:        q.Get("role"),
+		CreatedFrom: q.Get("created_from"),
+		CreatedTo:   q.Get("created_to"),
+	}
+
+	// 指定がなければ、これまでどおりBANされていないユーザーを出す
+	switch f.Status {
+	case "":
+		f.Status = "active"
+	case "active", "banned", "all":
+	default:
+		return f, false
+	}
+	if _, ok := rolePermissions[f.Role]; f.Role != "" && !ok {
+		return f, false
+	}
+	for _, d := range []string{f.CreatedFrom, f.CreatedTo} {
+		if _, err := time.ParseInLocation("2006-01-02", d, time.Local); d != "" && err != nil {
+			return f, false
+		}
+	}
+	if maxID := q.Get("max_id"); maxID != "" {
+		id, err := strconv.Atoi(maxID)
+		if err != nil {
+			return f, false
+		}
+		f.MaxID = id
+	}
+
+	return f, true
+}
+
+// 次のページのURLに付けるクエリ
+func (f adminUserFilter) nextQuery(maxID int) string {
+	v := url.Values{}
+	for key, value := range map[string]string{
+		"q":            f.Query,
+		"status":       f.Status,
+		"role":         f.Role,
+		"created_from": f.CreatedFrom,
+		"created_to":   f.CreatedTo,
+	} {
+		if value != "" {
+			v.Set(key, value)
+		}
+	}
+	v.Set("max_id", strconv.Itoa(maxID))
+	return v.Encode()
+}
+
+// アカウント名の前方一致に使うLIKEのパターン
+func likePrefix(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+	return s + "%"
+}
+
+// idの降順に1ページ分を返す。続きがあれば次のページのmax_idも返す
+func selectAdminUsers(f adminUserFilter) ([]AdminUser, int, error) {
+	where := "1=1"
+	args := []interface{}{}
+	if f.Query != "" {
+		where += " AND u.account_name LIKE ?"
+		args = append(args, likePrefix(f.Query))
+	}
+	switch f.Status {
+	case "active":
+		where += " AND u.del_flg = 0"
+	case "banned":
+		where += " AND u.del_flg = 1"
+	}
+	if f.Role != "" {
+		where += " AND u.role = ?"
+		args = append(args, f.Role)
+	}
+	if f.CreatedFrom != "" {
+		from, _ := time.ParseInLocation("2006-01-02", f.CreatedFrom, time.Local)
+		where += " AND u.created_at >= ?"
+		args = append(args, from)
+	}
+	if f.CreatedTo != "" {
+		to, _ := time.ParseInLocation("2006-01-02", f.CreatedTo, time.Local)
+		where += " AND u.created_at < ?"
+		args = append(args, to.AddDate(0, 0, 1))
+	}
+	if f.MaxID > 0 {
+		where += " AND u.id < ?"
+		args = append(args, f.MaxID)
+	}
+
+	// 1件多く取って次のページがあるかを判定する
+	users := []AdminUser{}
+	err := db.Select(&users,
+		"SELECT u.id, u.account_name, u.role, u.del_flg, u.created_at, "+
+			"b.reason, a.account_name AS admin_name, b.expires_at, b.created_at AS banned_at "+
+			"FROM `users` AS u LEFT JOIN `bans` AS b ON (b.user_id=u.id AND b.lifted_at IS NULL) "+
+			"LEFT JOIN `users` AS a ON (b.admin_id=a.id) "+
+			"WHERE "+where+" ORDER BY u.id DESC LIMIT ?",
+		append(args, adminUsersPerPage+1)...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	nextMaxID := 0
+	if len(users) > adminUsersPerPage {
+		users = users[:adminUsersPerPage]
+		nextMaxID = users[len(users)-1].ID
+	}
+	return users, nextMaxID, nil
+}
+
+type adminUserJSON struct {
+	ID          int        `json:"id"`
+	AccountName string     `json:"account_name"`
+	Role        string     `json:"role"`
+	Banned      bool       `json:"banned"`
+	BanReason   string     `json:"ban_reason,omitempty"`
+	BanExpires  *time.Time `json:"ban_expires_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+func getAdminUsersJSON(w http.ResponseWriter, r *http.Request) {
+	f, ok := parseAdminUserFilter(r)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	users, nextMaxID, err := selectAdminUsers(f)
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	res := struct {
+		Users     []adminUserJSON `json:"users"`
+		NextMaxID int             `json:"next_max_id,omitempty"`
+	}{make([]adminUserJSON, 0, len(users)), nextMaxID}
+	for _, u := range users {
+		uj := adminUserJSON{
+			ID:          u.ID,
+			AccountName: u.AccountName,
+			Role:        u.Role,
+			Banned:      u.IsBanned(),
+			BanReason:   u.Reason.String,
+			CreatedAt:   u.CreatedAt,
+		}
+		if u.ExpiresAt.Valid {
+			uj.BanExpires = &u.ExpiresAt.Time
+		}
+		res.Users = append(res.Users, uj)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestAdminUserLogoutableBy(t *testing.T) {
+	moderator := User{Role: roleModerator}
+	admin := User{Role: roleAdmin}
+
+	for _, tc := range []struct {
+		target AdminUser
+		me     User
+		want   bool
+	}{
+		{AdminUser{Role: roleUser}, moderator, true},
+		{AdminUser{Role: roleModerator}, moderator, false},
+		{AdminUser{Role: roleAdmin}, moderator, false},
+		{AdminUser{Role: roleModerator}, admin, true},
+		{AdminUser{Role: roleAdmin}, admin, true},
+		// BAN中のユーザーはもうログアウトしている
+		{AdminUser{Role: roleUser, DelFlg: 1}, admin, false},
+	} {
+		if got := tc.target.LogoutableBy(tc.me); got != tc.want {
+			t.Errorf("%s logging out %s (del_flg=%d): got %v", tc.me.Role, tc.target.Role, tc.target.DelFlg, got)
+		}
+	}
+}
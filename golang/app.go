@@ -3,17 +3,18 @@ package main
 import (
 	crand "crypto/rand"
 	"crypto/sha512"
+	"database/sql"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"html/template"
 	"io"
 	"log"
+	"mime/multipart"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
-	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -34,9 +35,33 @@ var (
 )
 
 const (
-	postsPerPage  = 20
-	ISO8601Format = "2006-01-02T15:04:05-07:00"
-	UploadLimit   = 10 * 1024 * 1024 // 10mb
+	postsPerPage         = 20
+	commentsPerPage      = 20
+	indexCommentsPerPost = 3
+	repliesPerThread     = 3 // スレッドごとに一覧に含める返信の件数
+	ISO8601Format        = "2006-01-02T15:04:05-07:00"
+	UploadLimit          = 10 * 1024 * 1024 // 10mb
+	imagesPerPostLimit   = 10
+)
+
+// 投稿の状態
+const (
+	postStatusPublished = 0
+	postStatusDraft     = 1
+	postStatusScheduled = 2
+)
+
+// 投稿の公開範囲
+const (
+	visibilityPublic    = 0
+	visibilityFollowers = 1
+	visibilityPrivate   = 2
+)
+
+const (
+	imageDir = "../image"
+	// 公開以外の投稿の画像はnginxから直接配信されない場所に置き、アプリで権限を確認して返す
+	privateImageDir = "../private_image"
 )
 
 type User struct {
@@ -46,28 +71,79 @@ type User struct {
 	Authority   int       `db:"authority"`
 	DelFlg      int       `db:"del_flg"`
 	CreatedAt   time.Time `db:"created_at"`
+	// これより前にログインしたセッションは無効
+	SessionsRevokedAt sql.NullTime `db:"sessions_revoked_at"`
+	// 権限はroleで管理する。authorityはadminかどうかと同期させているだけ
+	Role string `db:"role"`
+	// 2段階認証の秘密鍵と、最後に使われたコードのステップ。未設定ならNULL
+	TOTPSecret   sql.NullString `db:"totp_secret"`
+	TOTPLastStep int64          `db:"totp_last_step"`
+	// パスワードの再設定の連絡先。未登録ならNULL
+	Email sql.NullString `db:"email"`
+	// 削除を申請したアカウントを実際に消す時刻
+	DeletionScheduledAt sql.NullTime `db:"deletion_scheduled_at"`
+	// 初期データのauthority。/initializeでロールを戻すときに使う
+	SeedAuthority sql.NullInt64 `db:"seed_authority"`
 }
 
 type Post struct {
-	ID           int       `db:"id"`
-	UserID       int       `db:"user_id"`
-	Imgdata      []byte    `db:"imgdata"`
-	Body         string    `db:"body"`
-	Mime         string    `db:"mime"`
-	CreatedAt    time.Time `db:"created_at"`
+	ID           int          `db:"id"`
+	UserID       int          `db:"user_id"`
+	Imgdata      []byte       `db:"imgdata"`
+	Body         string       `db:"body"`
+	Mime         string       `db:"mime"`
+	Visibility   int          `db:"visibility"`
+	Status       int          `db:"status"`
+	PublishAt    sql.NullTime `db:"publish_at"`
+	CreatedAt    time.Time    `db:"created_at"`
 	CommentCount int
+	Images       []PostImage
 	Comments     []Comment
 	User         User
 	CSRFToken    string
+	// 投稿詳細ページで表示しきれていない古いコメントがあるか
+	// あるときは、続きをこのコメントより古いものから読む
+	HasOlderComments    bool
+	OlderCommentsCursor commentCursor
+}
+
+// コメントの一覧を読み進める位置。このコメントより古いものが続き
+type commentCursor struct {
+	ID        int       `db:"id"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+type PostImage struct {
+	ID        int       `db:"id"`
+	PostID    int       `db:"post_id"`
+	Position  int       `db:"position"`
+	Mime      string    `db:"mime"`
+	CreatedAt time.Time `db:"created_at"`
 }
 
 type Comment struct {
 	ID        int       `db:"id"`
 	PostID    int       `db:"post_id"`
 	UserID    int       `db:"user_id"`
+	ParentID  int       `db:"parent_id"`
 	Comment   string    `db:"comment"`
 	CreatedAt time.Time `db:"created_at"`
 	User      User
+	Replies   []Comment
+	CSRFToken string `json:"-"`
+	// Repliesに含めていない古い返信があるか。あるときは、続きをこの返信より古いものから読む
+	HasOlderReplies    bool
+	OlderRepliesCursor commentCursor
+}
+
+type Notification struct {
+	ID        int       `db:"id"`
+	UserID    int       `db:"user_id"`
+	ActorID   int       `db:"actor_id"`
+	PostID    int       `db:"post_id"`
+	CommentID int       `db:"comment_id"`
+	CreatedAt time.Time `db:"created_at"`
+	Actor     User      `db:"actor"`
 }
 
 func init() {
@@ -76,7 +152,7 @@ func init() {
 		memdAddr = "localhost:11211"
 	}
 	memcacheClient = memcache.New(memdAddr)
-	store = gsm.NewMemcacheStore(memcacheClient, "iscogram_", []byte("sendagaya"))
+	store = newSessionStore()
 	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
 }
 
@@ -85,8 +161,26 @@ func dbInitialize() {
 		"DELETE FROM users WHERE id > 1000",
 		"DELETE FROM posts WHERE id > 10000",
 		"DELETE FROM comments WHERE id > 100000",
+		"DELETE FROM post_images WHERE post_id > 10000",
 		"UPDATE users SET del_flg = 0",
 		"UPDATE users SET del_flg = 1 WHERE id % 50 = 0",
+		"UPDATE users SET authority = seed_authority WHERE seed_authority IS NOT NULL",
+		"UPDATE users SET role = IF(authority = 1, 'admin', 'user')",
+		"UPDATE users SET totp_secret = NULL WHERE totp_secret IS NOT NULL",
+		"TRUNCATE TABLE recovery_codes",
+		"TRUNCATE TABLE password_resets",
+		"UPDATE users SET deletion_scheduled_at = NULL WHERE deletion_scheduled_at IS NOT NULL",
+		"TRUNCATE TABLE user_sessions",
+		"TRUNCATE TABLE user_identities",
+		"TRUNCATE TABLE notifications",
+		"TRUNCATE TABLE follows",
+		"TRUNCATE TABLE blocks",
+		"TRUNCATE TABLE mutes",
+		"TRUNCATE TABLE collections",
+		"TRUNCATE TABLE collection_posts",
+		"TRUNCATE TABLE reports",
+		"TRUNCATE TABLE moderation_actions",
+		"TRUNCATE TABLE bans",
 	}
 
 	for _, sql := range sqls {
@@ -108,7 +202,8 @@ func deleteImageFiles() {
 			continue
 		}
 
-		idx, err := strconv.Atoi(parts[0])
+		// 2枚目以降の画像は {投稿ID}_{位置}.{拡張子}
+		idx, err := strconv.Atoi(strings.Split(parts[0], "_")[0])
 		if err != nil {
 			fmt.Println("Error converting string to integer:", err)
 			continue
@@ -132,18 +227,26 @@ func tryLogin(accountName, password string) *User {
 		return nil
 	}
 
-	if calculatePasshash(u.AccountName, password) == u.Passhash {
-		return &u
-	} else {
+	ok, needsRehash := verifyPassword(u, password)
+	if !ok {
 		return nil
 	}
+	if needsRehash {
+		rehashPassword(u, password)
+	}
+	return &u
 }
 
 func validateUser(accountName, password string) bool {
-	return regexp.MustCompile(`\A[0-9a-zA-Z_]{3,}\z`).MatchString(accountName) &&
+	return validateAccountName(accountName) &&
 		regexp.MustCompile(`\A[0-9a-zA-Z_]{6,}\z`).MatchString(password)
 }
 
+// 外部のアカウントで登録するときはパスワードがないので、アカウント名だけを確認する
+func validateAccountName(accountName string) bool {
+	return regexp.MustCompile(`\A[0-9a-zA-Z_]{3,}\z`).MatchString(accountName)
+}
+
 func digest(src string) string {
 	// 文字列をバイト配列に変換
 	data := []byte(src)
@@ -160,6 +263,7 @@ func calculateSalt(accountName string) string {
 	return digest(accountName)
 }
 
+// 初期データのパスワードハッシュの方式。新しいハッシュはhashPasswordで作る
 func calculatePasshash(accountName, password string) string {
 	return digest(password + ":" + calculateSalt(accountName))
 }
@@ -170,13 +274,18 @@ func getSession(r *http.Request) *sessions.Session {
 	return session
 }
 func getSessionUser(r *http.Request) User {
+	// requirePermissionで取得済みならそれを使う
+	if u, ok := r.Context().Value(sessionUserKey{}).(User); ok {
+		return u
+	}
+
 	session := getSession(r)
 	uid, ok := session.Values["user_id"]
 	if !ok || uid == nil {
 		return User{}
 	}
 
-	cacheKey := fmt.Sprintf("user_%v", uid)
+	cacheKey := userCacheKey(uid)
 	item, err := memcacheClient.Get(cacheKey)
 	if err != nil && err != memcache.ErrCacheMiss {
 		// キャッシュ取得時のエラーをログに記録
@@ -224,6 +333,10 @@ func getSessionUser(r *http.Request) User {
 		}
 	}
 
+	if isRevokedSession(session, u) || isRevokedSessionKey(session, u) {
+		return User{}
+	}
+
 	return u
 }
 
@@ -240,14 +353,171 @@ func getFlash(w http.ResponseWriter, r *http.Request, key string) string {
 	}
 }
 
-func makePosts(results []Post, csrfToken string, allComments bool) ([]Post, error) {
+func commentCountCacheKey(postID int) string {
+	return fmt.Sprintf("post:%d:commentCount", postID)
+}
+
+// コメント一覧は表示件数ごとに別のキーでキャッシュする
+func commentsCacheKey(postID, limit int) string {
+	return fmt.Sprintf("post:%d:comments:%d", postID, limit)
+}
+
+// コメントが追加されたときに投稿に紐づくキャッシュを破棄する
+func invalidateCommentsCache(postID int) {
+	keys := []string{
+		commentCountCacheKey(postID),
+		commentsCacheKey(postID, indexCommentsPerPost),
+		commentsCacheKey(postID, commentsPerPage),
+	}
+	for _, key := range keys {
+		err := memcacheClient.Delete(key)
+		if err != nil && err != memcache.ErrCacheMiss {
+			log.Print(err)
+		}
+	}
+}
+
+const commentColumns = "SELECT c.id, c.post_id, c.user_id, c.parent_id, c.comment, c.created_at, u.account_name as `user.account_name` " +
+	"FROM `comments` as c JOIN `users` as u ON c.user_id = u.id "
+
+// トップレベルのコメントを新しい順に取得するクエリを受け取り、
+// 古い順に並べ替えたうえで返信をぶら下げて返す
+func selectCommentThreads(query string, args ...interface{}) ([]Comment, error) {
+	comments := []Comment{}
+	err := db.Select(&comments, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, j := 0, len(comments)-1; i < j; i, j = i+1, j-1 {
+		comments[i], comments[j] = comments[j], comments[i]
+	}
+
+	if len(comments) == 0 {
+		return comments, nil
+	}
+
+	ids := make([]int, 0, len(comments))
+	index := make(map[int]int, len(comments))
+	for i, c := range comments {
+		ids = append(ids, c.ID)
+		index[c.ID] = i
+	}
+
+	// 返信はスレッドごとに新しいものからrepliesPerThread件だけ読み、キャッシュする値が大きくならないようにする
+	q, args, err := sqlx.In(
+		"SELECT r.id, r.post_id, r.user_id, r.parent_id, r.comment, r.created_at, r.`user.account_name`, r.total FROM ("+
+			"SELECT c.id, c.post_id, c.user_id, c.parent_id, c.comment, c.created_at, u.account_name as `user.account_name`, "+
+			"ROW_NUMBER() OVER (PARTITION BY c.parent_id ORDER BY c.created_at DESC, c.id DESC) AS `rn`, "+
+			"COUNT(*) OVER (PARTITION BY c.parent_id) AS `total` "+
+			"FROM `comments` as c JOIN `users` as u ON c.user_id = u.id WHERE c.parent_id IN (?)"+
+			") AS r WHERE r.rn <= ? ORDER BY r.created_at, r.id",
+		ids, repliesPerThread)
+	if err != nil {
+		return nil, err
+	}
+	replies := []struct {
+		Comment
+		Total int `db:"total"`
+	}{}
+	err = db.Select(&replies, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	for _, reply := range replies {
+		i := index[reply.ParentID]
+		// 古い順に並んでいるので、スレッドの最初の返信が続きの位置になる
+		if len(comments[i].Replies) == 0 && reply.Total > repliesPerThread {
+			comments[i].HasOlderReplies = true
+			comments[i].OlderRepliesCursor = commentCursor{ID: reply.ID, CreatedAt: reply.CreatedAt}
+		}
+		comments[i].Replies = append(comments[i].Replies, reply.Comment)
+	}
+
+	return comments, nil
+}
+
+// beforeより古いトップレベルのコメントを1ページ分読んだあとの続きの位置を返す
+// 返信は数えず、ミュートで表示しないコメントも数える。続きがなければfalse
+func nextCommentsCursor(postID int, before *commentCursor) (commentCursor, bool, error) {
+	return nextCursor("`post_id` = ? AND `parent_id` = 0", []interface{}{postID}, before)
+}
+
+// beforeより古い返信を1ページ分読んだあとの続きの位置を返す
+func nextRepliesCursor(parentID int, before commentCursor) (commentCursor, bool, error) {
+	return nextCursor("`parent_id` = ?", []interface{}{parentID}, &before)
+}
+
+// whereに当てはまるコメントを新しい順に1ページ分読んだあとの続きの位置
+func nextCursor(where string, args []interface{}, before *commentCursor) (commentCursor, bool, error) {
+	query := "SELECT `id`, `created_at` FROM `comments` WHERE " + where + " "
+	if before != nil {
+		query += "AND (`created_at` < ? OR (`created_at` = ? AND `id` < ?)) "
+		args = append(args, before.CreatedAt, before.CreatedAt, before.ID)
+	}
+	query += "ORDER BY `created_at` DESC, `id` DESC LIMIT 2 OFFSET ?"
+	args = append(args, commentsPerPage-1)
+
+	// ページの最後のコメントと、その次のコメントがあるかを見る
+	cursors := []commentCursor{}
+	err := db.Select(&cursors, query, args...)
+	if err != nil {
+		return commentCursor{}, false, err
+	}
+	if len(cursors) < 2 {
+		return commentCursor{}, false, nil
+	}
+	return cursors[0], true, nil
+}
+
+// 投稿IDごとに位置順に並べた画像を返す
+func selectPostImages(results []Post) (map[int][]PostImage, error) {
+	images := map[int][]PostImage{}
+	if len(results) == 0 {
+		return images, nil
+	}
+
+	ids := make([]int, 0, len(results))
+	for _, p := range results {
+		ids = append(ids, p.ID)
+	}
+
+	q, args, err := sqlx.In("SELECT * FROM `post_images` WHERE `post_id` IN (?) ORDER BY `post_id`, `position`", ids)
+	if err != nil {
+		return nil, err
+	}
+	rows := []PostImage{}
+	err = db.Select(&rows, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	for _, img := range rows {
+		images[img.PostID] = append(images[img.PostID], img)
+	}
+	return images, nil
+}
+
+// CSRFトークンはキャッシュに載せないので、取り出したあとに返信も含めて設定する
+func setCommentsCSRFToken(comments []Comment, csrfToken string) {
+	for i := range comments {
+		comments[i].CSRFToken = csrfToken
+		for j := range comments[i].Replies {
+			comments[i].Replies[j].CSRFToken = csrfToken
+		}
+	}
+}
+
+// commentLimitは投稿ごとに新しい順で取得するトップレベルのコメントの件数
+// meがミュートしている相手のコメントは取り除く
+func makePosts(results []Post, me User, csrfToken string, commentLimit int) ([]Post, error) {
 	var posts []Post
+	muted := mutedUserIDs(me)
 
 	// キャッシュから一括で取得するためのキーを準備
 	keys := make([]string, 0, len(results)*2)
 	for _, p := range results {
-		keys = append(keys, fmt.Sprintf("post:%d:commentCount", p.ID))
-		keys = append(keys, fmt.Sprintf("post:%d:comments", p.ID))
+		keys = append(keys, commentCountCacheKey(p.ID))
+		keys = append(keys, commentsCacheKey(p.ID, commentLimit))
 	}
 
 	// GetMultiを使用して一括でキャッシュされたデータを取得
@@ -256,8 +526,13 @@ func makePosts(results []Post, csrfToken string, allComments bool) ([]Post, erro
 		return nil, err
 	}
 
+	images, err := selectPostImages(results)
+	if err != nil {
+		return nil, err
+	}
+
 	for _, p := range results {
-		commentCountKey := fmt.Sprintf("post:%d:commentCount", p.ID)
+		commentCountKey := commentCountCacheKey(p.ID)
 		if item, found := items[commentCountKey]; found {
 			// キャッシュヒット
 			p.CommentCount, _ = strconv.Atoi(string(item.Value))
@@ -270,7 +545,7 @@ func makePosts(results []Post, csrfToken string, allComments bool) ([]Post, erro
 			memcacheClient.Set(&memcache.Item{Key: commentCountKey, Value: []byte(strconv.Itoa(p.CommentCount))})
 		}
 
-		commentsKey := fmt.Sprintf("post:%d:comments", p.ID)
+		commentsKey := commentsCacheKey(p.ID, commentLimit)
 		if item, found := items[commentsKey]; found {
 			// キャッシュヒット
 			err = json.Unmarshal(item.Value, &p.Comments)
@@ -279,11 +554,9 @@ func makePosts(results []Post, csrfToken string, allComments bool) ([]Post, erro
 			}
 		} else {
 			// キャッシュミス
-			query := "SELECT c.comment, c.created_at, u.account_name as `user.account_name` FROM `comments` as c JOIN `users` as u ON c.user_id = u.id WHERE `post_id` = ? ORDER BY `created_at` DESC"
-			if !allComments {
-				query += " LIMIT 3"
-			}
-			err = db.Select(&p.Comments, query, p.ID)
+			p.Comments, err = selectCommentThreads(
+				commentColumns+"WHERE c.post_id = ? AND c.parent_id = 0 ORDER BY c.created_at DESC, c.id DESC LIMIT ?",
+				p.ID, commentLimit)
 			if err != nil {
 				return nil, err
 			}
@@ -294,13 +567,13 @@ func makePosts(results []Post, csrfToken string, allComments bool) ([]Post, erro
 			memcacheClient.Set(&memcache.Item{Key: commentsKey, Value: commentsBytes})
 		}
 
-		// キャッシュミスだった場合、DBから取得してコメントを逆順にする
-		if _, found := items[commentsKey]; !found {
-			for i, j := 0, len(p.Comments)-1; i < j; i, j = i+1, j-1 {
-				p.Comments[i], p.Comments[j] = p.Comments[j], p.Comments[i]
-			}
+		p.Images = images[p.ID]
+		if len(p.Images) == 0 {
+			p.Images = []PostImage{{PostID: p.ID, Mime: p.Mime}}
 		}
 
+		p.Comments = filterMutedComments(p.Comments, muted)
+		setCommentsCSRFToken(p.Comments, csrfToken)
 		p.CSRFToken = csrfToken
 		posts = append(posts, p)
 	}
@@ -388,10 +661,61 @@ func imageURL(p Post) string {
 	return "/image/" + strconv.Itoa(p.ID) + ext
 }
 
+// 1枚目の画像は画像が1枚だった頃と同じURLになるようにする
+func postImageName(img PostImage) string {
+	if img.Position == 0 {
+		return fmt.Sprintf("%d.%s", img.PostID, getExtension(img.Mime))
+	}
+	return fmt.Sprintf("%d_%d.%s", img.PostID, img.Position, getExtension(img.Mime))
+}
+
+func postImageURL(img PostImage) string {
+	return "/image/" + postImageName(img)
+}
+
+func postImageFilename(dir string, img PostImage) string {
+	return dir + "/" + postImageName(img)
+}
+
+// nginxから直接配信してよいのは、公開済みで公開範囲が全体の投稿の画像だけ
+func postImageDir(p Post) string {
+	if p.Status == postStatusPublished && p.Visibility == visibilityPublic {
+		return imageDir
+	}
+	return privateImageDir
+}
+
 func isLogin(u User) bool {
 	return u.ID != 0
 }
 
+// postsをpという別名で参照するクエリに付け足して、meが閲覧できる投稿に絞り込む
+// 下書きや予約投稿は投稿者本人にだけ見える
+const visiblePostsCondition = "(p.user_id = ? OR (p.status = 0 AND (p.visibility = 0 OR " +
+	"(p.visibility = 1 AND EXISTS (SELECT 1 FROM `follows` AS f WHERE f.follower_id = ? AND f.followee_id = p.user_id)))))"
+
+// タイムラインなどの一覧では本人の下書きや予約投稿も出さない
+const publishedPostsCondition = "p.status = 0"
+
+func visiblePostsArgs(me User) []interface{} {
+	return []interface{}{me.ID, me.ID}
+}
+
+func canViewPost(me User, p Post) bool {
+	switch {
+	case isLogin(me) && me.ID == p.UserID:
+		return true
+	case p.Status != postStatusPublished:
+		return false
+	case p.Visibility == visibilityPublic:
+		return true
+	case p.Visibility == visibilityFollowers:
+		return isLogin(me) && isFollowing(me.ID, p.UserID)
+	default:
+		return false
+	}
+}
+
 func getCSRFToken(r *http.Request) string {
 	session := getSession(r)
 	csrfToken, ok := session.Values["csrf_token"]
@@ -434,10 +758,13 @@ func getLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	csrfToken := issueCSRFToken(w, r)
 	loginTemplate.Execute(w, struct {
-		Me    User
-		Flash string
-	}{me, getFlash(w, r, "notice")})
+		Me        User
+		Flash     string
+		CSRFToken string
+		Providers []*oidcProvider
+	}{me, getFlash(w, r, "notice"), csrfToken, oidcProviders})
 }
 
 func postLogin(w http.ResponseWriter, r *http.Request) {
@@ -446,15 +773,65 @@ func postLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	u := tryLogin(r.FormValue("account_name"), r.FormValue("password"))
+	accountName := r.FormValue("account_name")
+	throttles := []struct {
+		rule loginThrottleRule
+		id   string
+	}{
+		{accountLoginThrottle, accountName},
+		{ipLoginThrottle, clientIP(r)},
+	}
+
+	// memcacheに障害があってもログインはできるように、エラーはログに残すだけにする
+	// 試行は失敗として数えておき、成功したら取り消す
+	now := time.Now()
+	retryAt := time.Time{}
+	reserved := throttles[:0:0]
+	for _, t := range throttles {
+		at, err := reserveLoginAttempt(t.rule, t.id, now)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		if !at.IsZero() {
+			if at.After(retryAt) {
+				retryAt = at
+			}
+			continue
+		}
+		reserved = append(reserved, t)
+	}
+	if !retryAt.IsZero() {
+		// 一方の制限で断ったときは、もう一方で数えた分も取り消す
+		for _, t := range reserved {
+			if err := releaseLoginAttempt(t.rule, t.id, now); err != nil {
+				log.Print(err)
+			}
+		}
 
-	if u != nil {
 		session := getSession(r)
-		session.Values["user_id"] = u.ID
-		session.Values["csrf_token"] = secureRandomStr(16)
+		session.Values["notice"] = "ログインの試行回数が多すぎます。" + retryAt.Format("15:04:05") + "以降に再度お試しください"
 		session.Save(r, w)
 
-		http.Redirect(w, r, "/", http.StatusFound)
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	u := tryLogin(accountName, r.FormValue("password"))
+
+	if u != nil {
+		for _, t := range reserved {
+			if err := releaseLoginAttempt(t.rule, t.id, now); err != nil {
+				log.Print(err)
+			}
+		}
+		// 失敗の記録は2段階認証のコードの確認が済むまで残しておく
+		if !u.HasTOTP() {
+			if err := clearLoginFailures(accountLoginThrottle, accountName); err != nil {
+				log.Print(err)
+			}
+		}
+		completeLogin(w, r, *u)
 	} else {
 		session := getSession(r)
 		session.Values["notice"] = "アカウント名かパスワードが間違っています"
@@ -464,6 +841,29 @@ func postLogin(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// パスワードや外部のアカウントでの確認が済んだユーザーをログインさせる
+// 2段階認証を設定していれば、確認コードを入力するまでログインさせない
+func completeLogin(w http.ResponseWriter, r *http.Request, u User) {
+	if u.HasTOTP() {
+		session := getSession(r)
+		session.Values["pending_user_id"] = u.ID
+		session.Values["pending_at"] = time.Now().UnixNano()
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/login/2fa", http.StatusFound)
+		return
+	}
+
+	startLoginSession(w, r, u.ID)
+	if cancelAccountDeletion(u) {
+		session := getSession(r)
+		session.Values["notice"] = "アカウントの削除を取り消しました"
+		session.Save(r, w)
+	}
+
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
 var (
 	registerTemplate = template.Must(template.ParseFiles(
 		getTemplPath("layout.html"),
@@ -477,10 +877,12 @@ func getRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	csrfToken := issueCSRFToken(w, r)
 	registerTemplate.Execute(w, struct {
-		Me    User
-		Flash string
-	}{User{}, getFlash(w, r, "notice")})
+		Me        User
+		Flash     string
+		CSRFToken string
+	}{User{}, getFlash(w, r, "notice"), csrfToken})
 }
 
 func postRegister(w http.ResponseWriter, r *http.Request) {
@@ -514,30 +916,57 @@ func postRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	passhash, err := hashPassword(password)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
 	query := "INSERT INTO `users` (`account_name`, `passhash`) VALUES (?,?)"
-	result, err := db.Exec(query, accountName, calculatePasshash(accountName, password))
+	result, err := db.Exec(query, accountName, passhash)
 	if err != nil {
 		log.Print(err)
 		return
 	}
 
-	session := getSession(r)
 	uid, err := result.LastInsertId()
 	if err != nil {
 		log.Print(err)
 		return
 	}
-	session.Values["user_id"] = uid
-	session.Values["csrf_token"] = secureRandomStr(16)
-	session.Save(r, w)
+	startLoginSession(w, r, uid)
 
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
+var (
+	logoutTemplate = template.Must(template.ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("logout.html")),
+	)
+)
+
+// リンクを踏ませてログアウトさせられないよう、GETでは確認画面だけを出す
 func getLogout(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	csrfToken := issueCSRFToken(w, r)
+	logoutTemplate.Execute(w, struct {
+		Me        User
+		CSRFToken string
+	}{me, csrfToken})
+}
+
+func postLogout(w http.ResponseWriter, r *http.Request) {
+	revokeCurrentSession(r)
+
 	session := getSession(r)
 	delete(session.Values, "user_id")
-	session.Options = &sessions.Options{MaxAge: -1}
+	session.Options = expiredSessionOptions()
 	session.Save(r, w)
 
 	http.Redirect(w, r, "/", http.StatusFound)
@@ -545,12 +974,15 @@ func getLogout(w http.ResponseWriter, r *http.Request) {
 
 var (
 	indexTemplate = template.Must(template.New("layout.html").Funcs(template.FuncMap{
-		"imageURL": imageURL,
+		"imageURL":     imageURL,
+		"postImageURL": postImageURL,
 	}).ParseFiles(
 		getTemplPath("layout.html"),
 		getTemplPath("index.html"),
 		getTemplPath("posts.html"),
 		getTemplPath("post.html"),
+		getTemplPath("comment.html"),
+		getTemplPath("reply.html"),
 	))
 )
 
@@ -562,19 +994,20 @@ func getIndex(w http.ResponseWriter, r *http.Request) {
 	// err := db.Select(&results, "SELECT `id`, `user_id`, `body`, `mime`, `created_at` FROM `posts` ORDER BY `created_at` DESC")
 
 	err := db.Select(&results,
-		"SELECT STRAIGHT_JOIN p.id, p.user_id, p.body, p.mime, p.created_at, "+
+		"SELECT STRAIGHT_JOIN p.id, p.user_id, p.body, p.mime, p.visibility, p.status, p.publish_at, p.created_at, "+
 			"u.account_name as `user.account_name`"+
 			// "u.id as `user.id`, u.account_name as `user.account_name`, u.passhash as `user.passhash`,"+
 			// "u.authority as `user.authority`, u.del_flg as `user.del_flg`, u.created_at as `user.created_at`"+
 			" FROM `posts` AS p JOIN `users` AS u ON (p.user_id=u.id) "+
-			"WHERE u.del_flg=0 ORDER BY p.created_at DESC LIMIT ?", postsPerPage)
+			"WHERE u.del_flg=0 AND "+publishedPostsCondition+" AND "+visiblePostsCondition+" AND "+unmutedPostsCondition+" ORDER BY p.created_at DESC LIMIT ?",
+		append(visiblePostsArgs(me), me.ID, postsPerPage)...)
 
 	if err != nil {
 		log.Print(err)
 		return
 	}
 
-	posts, err := makePosts(results, getCSRFToken(r), false)
+	posts, err := makePosts(results, me, getCSRFToken(r), indexCommentsPerPost)
 	if err != nil {
 		log.Print(err)
 		return
@@ -590,12 +1023,15 @@ func getIndex(w http.ResponseWriter, r *http.Request) {
 
 var (
 	accountTemplate = template.Must(template.New("layout.html").Funcs(template.FuncMap{
-		"imageURL": imageURL,
+		"imageURL":     imageURL,
+		"postImageURL": postImageURL,
 	}).ParseFiles(
 		getTemplPath("layout.html"),
 		getTemplPath("user.html"),
 		getTemplPath("posts.html"),
 		getTemplPath("post.html"),
+		getTemplPath("comment.html"),
+		getTemplPath("reply.html"),
 	))
 )
 
@@ -614,24 +1050,34 @@ func getAccountName(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	me := getSessionUser(r)
+
+	// ブロックされている相手にはユーザーが存在しないように見せる
+	if isLogin(me) && isBlocking(user.ID, me.ID) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
 	results := []Post{}
 
 	// err = db.Select(&results, "SELECT `id`, `user_id`, `body`, `mime`, `created_at` FROM `posts` WHERE `user_id` = ? ORDER BY `created_at` DESC", user.ID)
 
+	args := append([]interface{}{user.ID}, visiblePostsArgs(me)...)
 	err = db.Select(&results,
-		"SELECT STRAIGHT_JOIN p.id, p.user_id, p.body, p.mime, p.created_at,"+
+		"SELECT STRAIGHT_JOIN p.id, p.user_id, p.body, p.mime, p.visibility, p.status, p.publish_at, p.created_at,"+
 			"u.account_name as `user.account_name`"+
 			// "u.id as `user.id`, u.account_name as `user.account_name`, u.passhash as `user.passhash`,"+
 			// "u.authority as `user.authority`, u.del_flg as `user.del_flg`, u.created_at as `user.created_at`"+
 			" FROM `posts` AS p JOIN `users` AS u ON (p.user_id=u.id) "+
-			"WHERE p.user_id = ? AND u.del_flg=0 ORDER BY p.created_at DESC LIMIT ?", user.ID, postsPerPage)
+			"WHERE p.user_id = ? AND u.del_flg=0 AND "+publishedPostsCondition+" AND "+visiblePostsCondition+" ORDER BY p.created_at DESC LIMIT ?",
+		append(args, postsPerPage)...)
 
 	if err != nil {
 		log.Print(err)
 		return
 	}
 
-	posts, err := makePosts(results, getCSRFToken(r), false)
+	posts, err := makePosts(results, me, getCSRFToken(r), indexCommentsPerPost)
 	if err != nil {
 		log.Print(err)
 		return
@@ -644,8 +1090,11 @@ func getAccountName(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 件数も一覧と同じく、見る人に公開されている投稿だけを数える
 	postIDs := []int{}
-	err = db.Select(&postIDs, "SELECT `id` FROM `posts` WHERE `user_id` = ?", user.ID)
+	err = db.Select(&postIDs,
+		"SELECT p.id FROM `posts` AS p WHERE p.user_id = ? AND "+publishedPostsCondition+" AND "+visiblePostsCondition,
+		append([]interface{}{user.ID}, visiblePostsArgs(me)...)...)
 	if err != nil {
 		log.Print(err)
 		return
@@ -673,7 +1122,9 @@ func getAccountName(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	me := getSessionUser(r)
+	following := isLogin(me) && isFollowing(me.ID, user.ID)
+	blocking := isLogin(me) && isBlocking(me.ID, user.ID)
+	muting := isLogin(me) && isMuting(me.ID, user.ID)
 
 	accountTemplate.Execute(w, struct {
 		Posts          []Post
@@ -681,16 +1132,23 @@ func getAccountName(w http.ResponseWriter, r *http.Request) {
 		PostCount      int
 		CommentCount   int
 		CommentedCount int
+		Following      bool
+		Blocking       bool
+		Muting         bool
 		Me             User
-	}{posts, user, postCount, commentCount, commentedCount, me})
+		CSRFToken      string
+	}{posts, user, postCount, commentCount, commentedCount, following, blocking, muting, me, getCSRFToken(r)})
 }
 
 var (
 	postsTemplate = template.Must(template.New("posts.html").Funcs(template.FuncMap{
-		"imageURL": imageURL,
+		"imageURL":     imageURL,
+		"postImageURL": postImageURL,
 	}).ParseFiles(
 		getTemplPath("posts.html"),
 		getTemplPath("post.html"),
+		getTemplPath("comment.html"),
+		getTemplPath("reply.html"),
 	))
 )
 
@@ -712,23 +1170,27 @@ func getPosts(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	me := getSessionUser(r)
+
 	results := []Post{}
 	// err = db.Select(&results, "SELECT `id`, `user_id`, `body`, `mime`, `created_at` FROM `posts` WHERE `created_at` <= ? ORDER BY `created_at` DESC", t.Format(ISO8601Format))
 
+	args := append([]interface{}{t.Format(ISO8601Format)}, visiblePostsArgs(me)...)
 	err = db.Select(&results,
-		"SELECT STRAIGHT_JOIN p.id, p.user_id, p.body, p.mime, p.created_at,"+
+		"SELECT STRAIGHT_JOIN p.id, p.user_id, p.body, p.mime, p.visibility, p.status, p.publish_at, p.created_at,"+
 			"u.account_name as `user.account_name`"+
 			// "u.id as `user.id`, u.account_name as `user.account_name`, u.passhash as `user.passhash`,"+
 			// "u.authority as `user.authority`, u.del_flg as `user.del_flg`, u.created_at as `user.created_at`"+
 			" FROM `posts` AS p JOIN `users` AS u ON (p.user_id=u.id) "+
-			"WHERE p.created_at <= ? AND u.del_flg=0 ORDER BY p.created_at DESC LIMIT ?", t.Format(ISO8601Format), postsPerPage)
+			"WHERE p.created_at <= ? AND u.del_flg=0 AND "+publishedPostsCondition+" AND "+visiblePostsCondition+" AND "+unmutedPostsCondition+" ORDER BY p.created_at DESC LIMIT ?",
+		append(args, me.ID, postsPerPage)...)
 
 	if err != nil {
 		log.Print(err)
 		return
 	}
 
-	posts, err := makePosts(results, getCSRFToken(r), false)
+	posts, err := makePosts(results, me, getCSRFToken(r), indexCommentsPerPost)
 	if err != nil {
 		log.Print(err)
 		return
@@ -744,11 +1206,14 @@ func getPosts(w http.ResponseWriter, r *http.Request) {
 
 var (
 	postsIdTemplate = template.Must(template.New("layout.html").Funcs(template.FuncMap{
-		"imageURL": imageURL,
+		"imageURL":     imageURL,
+		"postImageURL": postImageURL,
 	}).ParseFiles(
 		getTemplPath("layout.html"),
 		getTemplPath("post_id.html"),
 		getTemplPath("post.html"),
+		getTemplPath("comment.html"),
+		getTemplPath("reply.html"),
 	))
 )
 
@@ -760,20 +1225,24 @@ func getPostsID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	me := getSessionUser(r)
+
 	results := []Post{}
+	args := append([]interface{}{pid}, visiblePostsArgs(me)...)
 	err = db.Select(&results,
-		"SELECT STRAIGHT_JOIN p.id, p.user_id, p.body, p.mime, p.created_at,"+
+		"SELECT STRAIGHT_JOIN p.id, p.user_id, p.body, p.mime, p.visibility, p.status, p.publish_at, p.created_at,"+
 			"u.account_name as `user.account_name`"+
 			// "u.id as `user.id`, u.account_name as `user.account_name`, u.passhash as `user.passhash`,"+
 			// "u.authority as `user.authority`, u.del_flg as `user.del_flg`, u.created_at as `user.created_at`"+
 			" FROM `posts` AS p JOIN `users` AS u ON (p.user_id=u.id) "+
-			"WHERE p.id= ? AND u.del_flg=0 ORDER BY p.created_at DESC LIMIT ?", pid, postsPerPage)
+			"WHERE p.id= ? AND u.del_flg=0 AND "+visiblePostsCondition+" ORDER BY p.created_at DESC LIMIT ?",
+		append(args, postsPerPage)...)
 	if err != nil {
 		log.Print(err)
 		return
 	}
 
-	posts, err := makePosts(results, getCSRFToken(r), true)
+	posts, err := makePosts(results, me, getCSRFToken(r), commentsPerPage)
 	if err != nil {
 		log.Print(err)
 		return
@@ -785,13 +1254,163 @@ func getPostsID(w http.ResponseWriter, r *http.Request) {
 	}
 
 	p := posts[0]
+	p.OlderCommentsCursor, p.HasOlderComments, err = nextCommentsCursor(p.ID, nil)
+	if err != nil {
+		log.Print(err)
+		return
+	}
 
-	me := getSessionUser(r)
+	collections := []Collection{}
+	if isLogin(me) {
+		err = db.Select(&collections, "SELECT * FROM `collections` WHERE `user_id` = ? ORDER BY `created_at`", me.ID)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+	}
 
 	postsIdTemplate.Execute(w, struct {
-		Post Post
-		Me   User
-	}{p, me})
+		Post        Post
+		Collections []Collection
+		Me          User
+		CSRFToken   string
+	}{p, collections, me, getCSRFToken(r)})
+}
+
+var (
+	commentsTemplate = template.Must(template.New("comments.html").ParseFiles(
+		getTemplPath("comments.html"),
+		getTemplPath("comment.html"),
+		getTemplPath("reply.html"),
+	))
+	repliesTemplate = template.Must(template.New("replies.html").ParseFiles(
+		getTemplPath("replies.html"),
+		getTemplPath("reply.html"),
+	))
+)
+
+// 投稿詳細ページの「以前のコメントを見る」から呼ばれる
+// max_created_atとmax_idで指定したコメントより古いものを返す
+func getPostsIDComments(w http.ResponseWriter, r *http.Request) {
+	pid, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	m, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err)
+		return
+	}
+
+	t, err := time.Parse(ISO8601Format, m.Get("max_created_at"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	maxID, err := strconv.Atoi(m.Get("max_id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	me := getSessionUser(r)
+
+	post := Post{}
+	err = db.Get(&post, "SELECT `id`, `user_id`, `visibility`, `status` FROM `posts` WHERE `id` = ?", pid)
+	if err != nil || !canViewPost(me, post) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	comments, err := selectCommentThreads(
+		commentColumns+"WHERE c.post_id = ? AND c.parent_id = 0 "+
+			"AND (c.created_at < ? OR (c.created_at = ? AND c.id < ?)) "+
+			"ORDER BY c.created_at DESC, c.id DESC LIMIT ?",
+		pid, t, t, maxID, commentsPerPage)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	next, hasMore, err := nextCommentsCursor(pid, &commentCursor{ID: maxID, CreatedAt: t})
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	// ミュートで1件も表示しないページでも、続きの位置は返す
+	comments = filterMutedComments(comments, mutedUserIDs(me))
+	setCommentsCSRFToken(comments, getCSRFToken(r))
+
+	commentsTemplate.Execute(w, struct {
+		Comments []Comment
+		HasMore  bool
+		Next     commentCursor
+	}{comments, hasMore, next})
+}
+
+// スレッドの「以前の返信を見る」から呼ばれる
+// max_created_atとmax_idで指定した返信より古いものを返す
+func getCommentsIDReplies(w http.ResponseWriter, r *http.Request) {
+	cid, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	t, err := time.Parse(ISO8601Format, r.URL.Query().Get("max_created_at"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	maxID, err := strconv.Atoi(r.URL.Query().Get("max_id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	me := getSessionUser(r)
+
+	post := Post{}
+	err = db.Get(&post,
+		"SELECT p.id, p.user_id, p.visibility, p.status FROM `comments` AS c JOIN `posts` AS p ON c.post_id = p.id "+
+			"WHERE c.id = ? AND c.parent_id = 0", cid)
+	if err != nil || !canViewPost(me, post) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	replies := []Comment{}
+	err = db.Select(&replies,
+		commentColumns+"WHERE c.parent_id = ? "+
+			"AND (c.created_at < ? OR (c.created_at = ? AND c.id < ?)) "+
+			"ORDER BY c.created_at DESC, c.id DESC LIMIT ?",
+		cid, t, t, maxID, commentsPerPage)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	for i, j := 0, len(replies)-1; i < j; i, j = i+1, j-1 {
+		replies[i], replies[j] = replies[j], replies[i]
+	}
+
+	next, hasMore, err := nextRepliesCursor(cid, commentCursor{ID: maxID, CreatedAt: t})
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	replies = filterMutedComments(replies, mutedUserIDs(me))
+	setCommentsCSRFToken(replies, getCSRFToken(r))
+
+	repliesTemplate.Execute(w, struct {
+		Replies []Comment
+		HasMore bool
+		Next    commentCursor
+	}{replies, hasMore, next})
 }
 
 func postIndex(w http.ResponseWriter, r *http.Request) {
@@ -801,13 +1420,25 @@ func postIndex(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if r.FormValue("csrf_token") != getCSRFToken(r) {
-		w.WriteHeader(http.StatusUnprocessableEntity)
+	if isBanned(me) {
+		w.WriteHeader(http.StatusForbidden)
 		return
 	}
 
-	file, header, err := r.FormFile("file")
-	if err != nil {
+	// トークンをヘッダーで送るリクエストはcsrfProtectがフォームを読まないので、ここで読む
+	// multipartでないリクエストは画像がないものとして扱う
+	err := r.ParseMultipartForm(UploadLimit)
+	if err != nil && err != http.ErrNotMultipart {
+		log.Print(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var headers []*multipart.FileHeader
+	if r.MultipartForm != nil {
+		headers = r.MultipartForm.File["file"]
+	}
+	if len(headers) == 0 {
 		session := getSession(r)
 		session.Values["notice"] = "画像が必須です"
 		session.Save(r, w)
@@ -816,10 +1447,21 @@ func postIndex(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	mime := ""
-	if file != nil {
+	if len(headers) > imagesPerPostLimit {
+		session := getSession(r)
+		session.Values["notice"] = fmt.Sprintf("画像は%d枚までです", imagesPerPostLimit)
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	mimes := make([]string, 0, len(headers))
+	filedatas := make([][]byte, 0, len(headers))
+	for _, header := range headers {
 		// 投稿のContent-Typeからファイルのタイプを決定する
-		contentType := header.Header["Content-Type"][0]
+		mime := ""
+		contentType := header.Header.Get("Content-Type")
 		if strings.Contains(contentType, "jpeg") {
 			mime = "image/jpeg"
 		} else if strings.Contains(contentType, "png") {
@@ -834,31 +1476,69 @@ func postIndex(w http.ResponseWriter, r *http.Request) {
 			http.Redirect(w, r, "/", http.StatusFound)
 			return
 		}
+
+		if header.Size > UploadLimit {
+			session := getSession(r)
+			session.Values["notice"] = "ファイルサイズが大きすぎます"
+			session.Save(r, w)
+
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+
+		file, err := header.Open()
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		filedata, err := io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			log.Print(err)
+			return
+		}
+
+		mimes = append(mimes, mime)
+		filedatas = append(filedatas, filedata)
 	}
 
-	filedata, err := io.ReadAll(file)
-	if err != nil {
-		log.Print(err)
-		return
+	visibility, err := strconv.Atoi(r.FormValue("visibility"))
+	if err != nil || visibility < visibilityPublic || visibility > visibilityPrivate {
+		visibility = visibilityPublic
 	}
 
-	if len(filedata) > UploadLimit {
-		session := getSession(r)
-		session.Values["notice"] = "ファイルサイズが大きすぎます"
-		session.Save(r, w)
+	// 下書きと予約投稿は公開されるまでタイムラインに出さない
+	status := postStatusPublished
+	publishAt := sql.NullTime{}
+	switch r.FormValue("publish") {
+	case "draft":
+		status = postStatusDraft
+	case "schedule":
+		t, err := time.ParseInLocation("2006-01-02T15:04", r.FormValue("publish_at"), time.Local)
+		if err != nil || !t.After(time.Now()) {
+			session := getSession(r)
+			session.Values["notice"] = "予約投稿には未来の日時を指定してください"
+			session.Save(r, w)
 
-		http.Redirect(w, r, "/", http.StatusFound)
-		return
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+		status = postStatusScheduled
+		publishAt = sql.NullTime{Time: t, Valid: true}
 	}
 
-	query := "INSERT INTO `posts` (`user_id`, `mime`, `imgdata`, `body`) VALUES (?,?,?,?)"
+	// posts.mimeには1枚目の画像の形式を入れておき、既存の画像URLと互換にする
+	query := "INSERT INTO `posts` (`user_id`, `mime`, `imgdata`, `body`, `visibility`, `status`, `publish_at`) VALUES (?,?,?,?,?,?,?)"
 	result, err := db.Exec(
 		query,
 		me.ID,
-		mime,
+		mimes[0],
 		[]byte{},
 		// filedata,
 		r.FormValue("body"),
+		visibility,
+		status,
+		publishAt,
 	)
 	if err != nil {
 		log.Print(err)
@@ -871,10 +1551,7 @@ func postIndex(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	filename := fmt.Sprintf("../image/%d.%s", pid, getExtension(mime))
-
-	// ファイルのディレクトリ部分を取得
-	dir := filepath.Dir(filename)
+	dir := postImageDir(Post{Visibility: visibility, Status: status})
 
 	// ディレクトリが存在しない場合、ディレクトリを作成
 	if _, err := os.Stat(dir); os.IsNotExist(err) {
@@ -883,12 +1560,41 @@ func postIndex(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	err = os.WriteFile(filename, filedata, 0644)
-	if err != nil {
-		log.Print("Could not write file: ", err)
+	images := make([]PostImage, 0, len(mimes))
+	for i, mime := range mimes {
+		img := PostImage{PostID: int(pid), Position: i, Mime: mime}
+
+		_, err = db.Exec("INSERT INTO `post_images` (`post_id`, `position`, `mime`) VALUES (?,?,?)", img.PostID, img.Position, img.Mime)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+
+		err = os.WriteFile(postImageFilename(dir, img), filedatas[i], 0644)
+		if err != nil {
+			log.Print("Could not write file: ", err)
+			return
+		}
+
+		images = append(images, img)
+	}
+
+	if status != postStatusPublished {
+		http.Redirect(w, r, "/drafts", http.StatusFound)
 		return
 	}
 
+	publishPost(Post{
+		ID:         int(pid),
+		UserID:     me.ID,
+		Body:       r.FormValue("body"),
+		Mime:       mimes[0],
+		Visibility: visibility,
+		CreatedAt:  time.Now(),
+		Images:     images,
+		User:       me,
+	})
+
 	http.Redirect(w, r, "/posts/"+strconv.FormatInt(pid, 10), http.StatusFound)
 }
 
@@ -905,8 +1611,19 @@ func getExtension(mime string) string {
 	}
 }
 
+// 2枚目以降の画像は /image/{投稿ID}_{位置}.{拡張子} で配信する
 func getImage(w http.ResponseWriter, r *http.Request) {
 	pidStr := chi.URLParam(r, "id")
+	position := 0
+	if i := strings.Index(pidStr, "_"); i >= 0 {
+		p, err := strconv.Atoi(pidStr[i+1:])
+		if err != nil || p <= 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		position = p
+		pidStr = pidStr[:i]
+	}
 	pid, err := strconv.Atoi(pidStr)
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
@@ -920,11 +1637,43 @@ func getImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !canViewPost(getSessionUser(r), post) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	img := PostImage{PostID: post.ID, Position: position, Mime: post.Mime}
+	if position > 0 {
+		err = db.Get(&img, "SELECT * FROM `post_images` WHERE `post_id` = ? AND `position` = ?", post.ID, position)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	}
+
 	ext := chi.URLParam(r, "ext")
 
-	if ext == "jpg" && post.Mime == "image/jpeg" ||
-		ext == "png" && post.Mime == "image/png" ||
-		ext == "gif" && post.Mime == "image/gif" {
+	if ext == "jpg" && img.Mime == "image/jpeg" ||
+		ext == "png" && img.Mime == "image/png" ||
+		ext == "gif" && img.Mime == "image/gif" {
+		if postImageDir(post) == privateImageDir {
+			// 公開範囲が限られた画像はキャッシュ用に書き出さず、共有キャッシュにも載せない
+			w.Header().Set("Cache-Control", "private, no-cache")
+			http.ServeFile(w, r, postImageFilename(privateImageDir, img))
+			return
+		}
+
+		// DBに画像を持たない投稿はファイルから返す
+		// 公開されたばかりでまだ移動が済んでいなければ非公開側にある
+		if position > 0 || len(post.Imgdata) == 0 {
+			filename := postImageFilename(imageDir, img)
+			if _, err := os.Stat(filename); err != nil {
+				filename = postImageFilename(privateImageDir, img)
+			}
+			http.ServeFile(w, r, filename)
+			return
+		}
+
 		w.Header().Set("Content-Type", post.Mime)
 		_, err := w.Write(post.Imgdata)
 		if err != nil {
@@ -932,7 +1681,7 @@ func getImage(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		// // ファイルに書き出す
-		filename := "../image/" + pidStr + "." + ext
+		filename := imageDir + "/" + pidStr + "." + ext
 		err = os.WriteFile(filename, post.Imgdata, 0666)
 		os.Chmod(filename, 0666)
 		if err != nil {
@@ -952,8 +1701,8 @@ func postComment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if r.FormValue("csrf_token") != getCSRFToken(r) {
-		w.WriteHeader(http.StatusUnprocessableEntity)
+	if isBanned(me) {
+		w.WriteHeader(http.StatusForbidden)
 		return
 	}
 
@@ -963,67 +1712,144 @@ func postComment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	query := "INSERT INTO `comments` (`post_id`, `user_id`, `comment`) VALUES (?,?,?)"
-	_, err = db.Exec(query, postID, me.ID, r.FormValue("comment"))
+	post := Post{}
+	err = db.Get(&post, "SELECT `id`, `user_id`, `visibility`, `status` FROM `posts` WHERE `id` = ?", postID)
+	if err != nil || !canViewPost(me, post) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if isBlocking(post.UserID, me.ID) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	// 返信は1段階までなので、返信への返信はスレッドの先頭のコメントにぶら下げる
+	parent := Comment{}
+	if r.FormValue("parent_id") != "" {
+		parentID, err := strconv.Atoi(r.FormValue("parent_id"))
+		if err != nil {
+			log.Print("parent_idは整数のみです")
+			return
+		}
+		err = db.Get(&parent, "SELECT `id`, `post_id`, `user_id`, `parent_id` FROM `comments` WHERE `id` = ?", parentID)
+		if err != nil || parent.PostID != postID {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	}
+	threadID := parent.ID
+	if parent.ParentID != 0 {
+		threadID = parent.ParentID
+	}
+
+	query := "INSERT INTO `comments` (`post_id`, `user_id`, `parent_id`, `comment`) VALUES (?,?,?,?)"
+	result, err := db.Exec(query, postID, me.ID, threadID, r.FormValue("comment"))
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	invalidateCommentsCache(postID)
+
+	cid, err := result.LastInsertId()
 	if err != nil {
 		log.Print(err)
 		return
 	}
 
+	publishComment(post, Comment{
+		ID:        int(cid),
+		PostID:    postID,
+		UserID:    me.ID,
+		ParentID:  threadID,
+		Comment:   r.FormValue("comment"),
+		CreatedAt: time.Now(),
+		User:      me,
+	})
+
+	if parent.ID != 0 && parent.UserID != me.ID {
+		_, err = db.Exec(
+			"INSERT INTO `notifications` (`user_id`, `actor_id`, `post_id`, `comment_id`) VALUES (?,?,?,?)",
+			parent.UserID, me.ID, postID, cid)
+		if err != nil {
+			log.Print(err)
+		}
+	}
+
 	http.Redirect(w, r, fmt.Sprintf("/posts/%d", postID), http.StatusFound)
 }
 
 var (
-	adminBannnedtTemplate = template.Must(template.ParseFiles(
+	notificationsTemplate = template.Must(template.ParseFiles(
 		getTemplPath("layout.html"),
-		getTemplPath("banned.html")),
+		getTemplPath("notifications.html")),
 	)
 )
 
-func getAdminBanned(w http.ResponseWriter, r *http.Request) {
+func getNotifications(w http.ResponseWriter, r *http.Request) {
 	me := getSessionUser(r)
 	if !isLogin(me) {
-		http.Redirect(w, r, "/", http.StatusFound)
-		return
-	}
-
-	if me.Authority == 0 {
-		w.WriteHeader(http.StatusForbidden)
+		http.Redirect(w, r, "/login", http.StatusFound)
 		return
 	}
 
-	users := []User{}
-	err := db.Select(&users, "SELECT * FROM `users` WHERE `authority` = 0 AND `del_flg` = 0 ORDER BY `created_at` DESC")
+	notifications := []Notification{}
+	err := db.Select(&notifications,
+		"SELECT n.id, n.user_id, n.actor_id, n.post_id, n.comment_id, n.created_at, u.account_name as `actor.account_name` "+
+			"FROM `notifications` AS n JOIN `users` AS u ON (n.actor_id=u.id) "+
+			"WHERE n.user_id = ? AND u.del_flg=0 ORDER BY n.created_at DESC LIMIT ?", me.ID, postsPerPage)
 	if err != nil {
 		log.Print(err)
 		return
 	}
 
-	adminBannnedtTemplate.Execute(w, struct {
-		Users     []User
-		Me        User
-		CSRFToken string
-	}{users, me, getCSRFToken(r)})
+	notificationsTemplate.Execute(w, struct {
+		Notifications []Notification
+		Me            User
+	}{notifications, me})
 }
 
-func postAdminBanned(w http.ResponseWriter, r *http.Request) {
+var (
+	adminBannnedtTemplate = template.Must(template.ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("banned.html")),
+	)
+)
+
+func getAdminBanned(w http.ResponseWriter, r *http.Request) {
 	me := getSessionUser(r)
-	if !isLogin(me) {
-		http.Redirect(w, r, "/", http.StatusFound)
+
+	f, ok := parseAdminUserFilter(r)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	if me.Authority == 0 {
-		w.WriteHeader(http.StatusForbidden)
+	users, nextMaxID, err := selectAdminUsers(f)
+	if err != nil {
+		log.Print(err)
 		return
 	}
 
-	if r.FormValue("csrf_token") != getCSRFToken(r) {
-		w.WriteHeader(http.StatusUnprocessableEntity)
-		return
+	// クエリ文字列全体が値としてエスケープされないようにtemplate.URLで渡す
+	var nextURL template.URL
+	if nextMaxID > 0 {
+		nextURL = template.URL("/admin/banned?" + f.nextQuery(nextMaxID))
 	}
 
-	query := "UPDATE `users` SET `del_flg` = ? WHERE `id` = ?"
+	adminBannnedtTemplate.Execute(w, struct {
+		Users     []AdminUser
+		Filter    adminUserFilter
+		Roles     []string
+		NextURL   template.URL
+		Me        User
+		CSRFToken string
+		Flash     string
+	}{users, f, roles, nextURL, me, getCSRFToken(r), getFlash(w, r, "notice")})
+}
+
+func postAdminBanned(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
 
 	err := r.ParseForm()
 	if err != nil {
@@ -1031,8 +1857,38 @@ func postAdminBanned(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	duration, ok := banDurations[r.FormValue("duration")]
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	expiresAt := sql.NullTime{}
+	if duration > 0 {
+		expiresAt = sql.NullTime{Time: time.Now().Add(duration), Valid: true}
+	}
+
+	skipped := 0
 	for _, id := range r.Form["uid[]"] {
-		db.Exec(query, 1, id)
+		uid, err := strconv.Atoi(id)
+		if err != nil {
+			continue
+		}
+		err = banUser(me.ID, uid, r.FormValue("reason"), expiresAt)
+		if err == errNotBannable {
+			skipped++
+			continue
+		}
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		recordModerationAction(me.ID, "ban", reportTargetUser, uid, 0)
+	}
+
+	if skipped > 0 {
+		session := getSession(r)
+		session.Values["notice"] = fmt.Sprintf("%d人のユーザーは管理者かモデレーターのため、BANしませんでした", skipped)
+		session.Save(r, w)
 	}
 
 	http.Redirect(w, r, "/admin/banned", http.StatusFound)
@@ -1080,23 +1936,93 @@ func main() {
 	db.SetMaxOpenConns(32)
 	db.SetMaxIdleConns(32)
 
+	dbMigrate()
+	loadPasswordHashConfig()
+	loadNotifier()
+	loadOIDCProviders()
+
+	startPeriodicJob("publish scheduled posts", scheduledPostsInterval, publishScheduledPosts)
+	startPeriodicJob("refresh popular ranking", popularInterval, refreshPopularRanking)
+	startPeriodicJob("lift expired bans", banSweepInterval, liftExpiredBans)
+	startPeriodicJob("refresh dashboard stats", dashboardInterval, refreshDashboardStats)
+	startPeriodicJob("purge deleted accounts", accountPurgeInterval, purgeDeletedAccounts)
+
 	r := chi.NewRouter()
+	r.Use(securityHeaders)
+	r.Use(csrfProtect)
 
 	r.Get("/initialize", getInitialize)
+	r.Post(cspReportPath, postCSPReport)
 	r.Get("/login", getLogin)
 	r.Post("/login", postLogin)
 	r.Get("/register", getRegister)
 	r.Post("/register", postRegister)
+	r.Get("/login/2fa", getLoginTwoFactor)
+	r.Post("/login/2fa", postLoginTwoFactor)
 	r.Get("/logout", getLogout)
+	r.Post("/logout", postLogout)
+	r.Get("/oidc/{provider}/login", getOIDCLogin)
+	r.Get("/oidc/{provider}/link", getOIDCLink)
+	r.Get("/oidc/{provider}/callback", getOIDCCallback)
+	r.Get("/oidc/signup", getOIDCSignupPage)
+	r.Post("/oidc/signup", postOIDCSignup)
+	r.Get("/password/reset", getPasswordReset)
+	r.Post("/password/reset", postPasswordReset)
+	r.Get("/password/reset/{token}", getPasswordResetToken)
+	r.Post("/password/reset/{token}", postPasswordResetToken)
 	r.Get("/", getIndex)
 	r.Get("/posts", getPosts)
+	r.Get("/popular", getPopular)
+	r.Get("/popular.json", getPopularJSON)
 	r.Get("/posts/{id}", getPostsID)
+	r.Get("/posts/{id}/comments", getPostsIDComments)
+	r.Get("/comments/{id}/replies", getCommentsIDReplies)
 	r.Post("/", postIndex)
 	r.Get("/image/{id}.{ext}", getImage)
 	r.Post("/comment", postComment)
-	r.Get("/admin/banned", getAdminBanned)
-	r.Post("/admin/banned", postAdminBanned)
+	r.Get("/notifications", getNotifications)
+	r.Get("/events", getEvents)
+	r.Get("/drafts", getDrafts)
+	r.Post("/drafts/publish", postDraftsPublish)
+	r.With(requirePermission(permViewDashboard)).Get("/admin", getAdminDashboard)
+	r.With(requirePermission(permBan)).Get("/admin/banned", getAdminBanned)
+	r.With(requirePermission(permBan)).Post("/admin/banned", postAdminBanned)
+	r.With(requirePermission(permBan)).Get("/admin/users.json", getAdminUsersJSON)
+	r.With(requirePermission(permBan)).Post("/admin/unban", postAdminUnban)
+	r.With(requirePermission(permBan)).Post("/admin/logout", postAdminLogout)
+	r.Post("/report", postReport)
+	r.With(requirePermission(permViewReports)).Get("/admin/reports", getAdminReports)
+	r.With(requirePermission(permViewReports)).Post("/admin/reports/{id}", postAdminReport)
+	r.With(requirePermission(permManageRoles)).Get("/admin/roles", getAdminRoles)
+	r.With(requirePermission(permManageRoles)).Post("/admin/roles", postAdminRoles)
 	r.Get(`/@{accountName:[a-zA-Z]+}`, getAccountName)
+	r.Get(`/@{accountName:[a-zA-Z]+}/collections`, getCollections)
+	r.Get(`/@{accountName:[a-zA-Z]+}/collections/{slug}`, getCollection)
+	r.Post("/collections", postCollections)
+	r.Post("/collections/{slug}/add", postCollectionAdd)
+	r.Post("/collections/{slug}/remove", postCollectionRemove)
+	r.Post("/collections/{slug}/move", postCollectionMove)
+	r.Get("/settings/password", getPasswordSettings)
+	r.Post("/settings/password", postPasswordSettings)
+	r.Post("/settings/email", postEmailSettings)
+	r.Get("/settings/account", getAccountSettings)
+	r.Get("/settings/export", getAccountExport)
+	r.Post("/settings/delete", postAccountDelete)
+	r.Get("/settings/sessions", getSessions)
+	r.Post("/settings/sessions/revoke", postSessionRevoke)
+	r.Post("/settings/sessions/revoke-all", postSessionRevokeAll)
+	r.Get("/settings/connections", getConnections)
+	r.Post("/settings/connections/unlink", postConnectionUnlink)
+	r.Get("/settings/2fa", getTwoFactorSettings)
+	r.Post("/settings/2fa/enable", postTwoFactorEnable)
+	r.Post("/settings/2fa/disable", postTwoFactorDisable)
+	r.Post("/settings/2fa/recovery-codes", postTwoFactorRecoveryCodes)
+	r.Post("/follow", postFollow)
+	r.Post("/unfollow", postUnfollow)
+	r.Post("/block", postBlock)
+	r.Post("/unblock", postUnblock)
+	r.Post("/mute", postMute)
+	r.Post("/unmute", postUnmute)
 	r.Get("/*", func(w http.ResponseWriter, r *http.Request) {
 		http.FileServer(http.Dir("../public")).ServeHTTP(w, r)
 	})
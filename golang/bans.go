@@ -0,0 +1,197 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/gorilla/sessions"
+)
+
+const banSweepInterval = time.Minute
+
+var errNotBannable = errors.New("ban: user does not exist or is not a regular user")
+
+// 期限付きBANの選択肢。0は無期限
+var banDurations = map[string]time.Duration{
+	"":    0,
+	"1d":  24 * time.Hour,
+	"7d":  7 * 24 * time.Hour,
+	"30d": 30 * 24 * time.Hour,
+}
+
+func userCacheKey(userID interface{}) string {
+	return fmt.Sprintf("user_%v", userID)
+}
+
+// getSessionUserがキャッシュしているユーザー情報を捨てる
+// users を更新したら呼ばないと、最大で5分間古い情報のまま動いてしまう
+func invalidateUserCache(userID int) {
+	err := memcacheClient.Delete(userCacheKey(userID))
+	if err != nil && err != memcache.ErrCacheMiss {
+		log.Print(err)
+	}
+}
+
+func isBanned(u User) bool {
+	return u.DelFlg != 0
+}
+
+// セッションの保存先のmemcacheからはユーザーごとにセッションを探せないので、
+// ログインした時刻をセッションに持たせて、無効にした時刻より前のものを弾く
+func isRevokedSession(session *sessions.Session, u User) bool {
+	if !u.SessionsRevokedAt.Valid {
+		return false
+	}
+	loggedInAt, _ := session.Values["logged_in_at"].(int64)
+	return loggedInAt <= u.SessionsRevokedAt.Time.UnixNano()
+}
+
+// users.del_flgはBAN中かどうかを素早く判定するためのフラグで、
+// 理由や期限などの履歴はbansに持つ。有効なBANはlifted_atがNULLのもの
+// 管理者やモデレーターはBANできないので、そのときはerrNotBannableを返す
+func banUser(adminID, userID int, reason string, expiresAt sql.NullTime) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// BANと同時にそれまでのセッションもすべて無効にする
+	// ログインした時刻はアプリの時計で記録しているので、MySQLの時計ではなくこちらの時刻で比べる
+	now := time.Now()
+	result, err := tx.Exec("UPDATE `users` SET `del_flg` = 1, `sessions_revoked_at` = ? WHERE `id` = ? AND `role` = ?", now, userID, roleUser)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errNotBannable
+	}
+
+	sessionKeys := []string{}
+	err = tx.Select(&sessionKeys, "SELECT `session_key` FROM `user_sessions` WHERE `user_id` = ? AND `revoked_at` IS NULL", userID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE `user_sessions` SET `revoked_at` = ? WHERE `user_id` = ? AND `revoked_at` IS NULL", now, userID)
+	if err != nil {
+		return err
+	}
+
+	// BAN中にもう一度BANした場合は新しい内容で置き換える
+	_, err = tx.Exec("UPDATE `bans` SET `lifted_at` = NOW(), `lifted_by` = ? WHERE `user_id` = ? AND `lifted_at` IS NULL", adminID, userID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO `bans` (`user_id`, `admin_id`, `reason`, `expires_at`) VALUES (?,?,?,?)", userID, adminID, reason, expiresAt)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	invalidateUserCache(userID)
+	forgetSessionStatuses(sessionKeys)
+	return nil
+}
+
+// adminIDが0のときは期限切れによる自動解除
+func unbanUser(adminID, userID int) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE `bans` SET `lifted_at` = NOW(), `lifted_by` = ? WHERE `user_id` = ? AND `lifted_at` IS NULL", adminID, userID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE `users` SET `del_flg` = 0 WHERE `id` = ?", userID)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	invalidateUserCache(userID)
+	return nil
+}
+
+// 期限の切れたBANを解除する
+// 解除は条件付きのUPDATEで行うので、複数のプロセスで動いていても一度だけ記録される
+func liftExpiredBans() error {
+	bans := []struct {
+		ID     int `db:"id"`
+		UserID int `db:"user_id"`
+	}{}
+	err := db.Select(&bans, "SELECT `id`, `user_id` FROM `bans` WHERE `lifted_at` IS NULL AND `expires_at` <= ?", time.Now())
+	if err != nil {
+		return err
+	}
+
+	for _, ban := range bans {
+		tx, err := db.Beginx()
+		if err != nil {
+			return err
+		}
+
+		result, err := tx.Exec("UPDATE `bans` SET `lifted_at` = NOW(), `lifted_by` = 0 WHERE `id` = ? AND `lifted_at` IS NULL", ban.ID)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if n == 0 {
+			tx.Rollback()
+			continue
+		}
+		_, err = tx.Exec("UPDATE `users` SET `del_flg` = 0 WHERE `id` = ?", ban.UserID)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		invalidateUserCache(ban.UserID)
+
+		recordModerationAction(0, "unban", reportTargetUser, ban.UserID, 0)
+	}
+
+	return nil
+}
+
+func postAdminUnban(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+
+	uid, err := strconv.Atoi(r.FormValue("uid"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = unbanUser(me.ID, uid)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	recordModerationAction(me.ID, "unban", reportTargetUser, uid, 0)
+
+	http.Redirect(w, r, "/admin/banned", http.StatusFound)
+}
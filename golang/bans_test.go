@@ -0,0 +1,56 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/gorilla/sessions"
+)
+
+func TestIsRevokedSession(t *testing.T) {
+	revokedAt := time.Now()
+	u := User{SessionsRevokedAt: sql.NullTime{Time: revokedAt, Valid: true}}
+
+	for _, tc := range []struct {
+		loggedInAt time.Time
+		want       bool
+	}{
+		{revokedAt.Add(-time.Second), true},
+		{revokedAt, true},
+		{revokedAt.Add(time.Microsecond), false},
+	} {
+		session := sessions.NewSession(store, defaultSessionPrefix)
+		session.Values["logged_in_at"] = tc.loggedInAt.UnixNano()
+		if got := isRevokedSession(session, u); got != tc.want {
+			t.Errorf("logged in %v after revoke: got %v", tc.loggedInAt.Sub(revokedAt), got)
+		}
+	}
+
+	session := sessions.NewSession(store, defaultSessionPrefix)
+	session.Values["logged_in_at"] = revokedAt.Add(-time.Hour).UnixNano()
+	if isRevokedSession(session, User{}) {
+		t.Error("a user who never revoked sessions must stay logged in")
+	}
+}
+
+func TestForgetSessionStatuses(t *testing.T) {
+	useMemcachedStandIn(t)
+
+	for _, key := range []string{"a", "b"} {
+		err := memcacheClient.Set(&memcache.Item{Key: sessionStatusCacheKey(key), Value: []byte("active")})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// キャッシュにないキーが混ざっていてもよい
+	forgetSessionStatuses([]string{"a", "b", "c"})
+
+	for _, key := range []string{"a", "b"} {
+		if _, err := memcacheClient.Get(sessionStatusCacheKey(key)); err != memcache.ErrCacheMiss {
+			t.Errorf("session_status for %q is still cached: %v", key, err)
+		}
+	}
+}
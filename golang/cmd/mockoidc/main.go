@@ -0,0 +1,41 @@
+// 外部アカウントでのログインを手元で試すための、最小限のOpenID Connectプロバイダ
+//
+//	go run ./cmd/mockoidc -listen localhost:9000
+//
+// アプリ側は次のように設定する
+//
+//	ISUCONP_BASE_URL=http://localhost
+//	ISUCONP_OIDC_PROVIDERS=mock
+//	ISUCONP_OIDC_MOCK_ISSUER=http://localhost:9000
+//	ISUCONP_OIDC_MOCK_CLIENT_ID=iscogram
+//	ISUCONP_OIDC_MOCK_CLIENT_SECRET=iscogram-secret
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"github.com/catatsuy/private-isu/webapp/golang/mockoidc"
+)
+
+func main() {
+	listen := flag.String("listen", "localhost:9000", "address to listen on")
+	issuer := flag.String("issuer", "", "issuer URL (default http://{listen})")
+	clientID := flag.String("client-id", "iscogram", "client ID to accept")
+	clientSecret := flag.String("client-secret", "iscogram-secret", "client secret to accept")
+	flag.Parse()
+
+	if *issuer == "" {
+		*issuer = "http://" + *listen
+	}
+
+	// 起動するたびに鍵を作り直すので、発行済みのIDトークンは再起動すると検証できなくなる
+	p, err := mockoidc.New(*issuer, *clientID, *clientSecret)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("mock OIDC provider: issuer=%s client_id=%s", p.Issuer(), *clientID)
+	log.Fatal(http.ListenAndServe(*listen, p))
+}
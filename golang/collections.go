@@ -0,0 +1,286 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const collectionPostsLimit = 100
+
+type Collection struct {
+	ID        int       `db:"id"`
+	UserID    int       `db:"user_id"`
+	Slug      string    `db:"slug"`
+	Name      string    `db:"name"`
+	IsPublic  bool      `db:"is_public"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+var collectionSlugPattern = regexp.MustCompile(`\A[0-9a-z_-]{1,64}\z`)
+
+func getCollectionOwner(w http.ResponseWriter, r *http.Request, me User) (User, bool) {
+	user := User{}
+	err := db.Get(&user, "SELECT * FROM `users` WHERE `account_name` = ? AND `del_flg` = 0", chi.URLParam(r, "accountName"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return User{}, false
+	}
+
+	if isLogin(me) && isBlocking(user.ID, me.ID) {
+		w.WriteHeader(http.StatusNotFound)
+		return User{}, false
+	}
+
+	return user, true
+}
+
+var (
+	collectionsTemplate = template.Must(template.ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("collections.html")),
+	)
+)
+
+func getCollections(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	user, ok := getCollectionOwner(w, r, me)
+	if !ok {
+		return
+	}
+
+	collections := []Collection{}
+	err := db.Select(&collections,
+		"SELECT * FROM `collections` WHERE `user_id` = ? AND (`is_public` = 1 OR `user_id` = ?) ORDER BY `created_at` DESC",
+		user.ID, me.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	collectionsTemplate.Execute(w, struct {
+		User        User
+		Collections []Collection
+		Me          User
+		CSRFToken   string
+		Flash       string
+	}{user, collections, me, getCSRFToken(r), getFlash(w, r, "notice")})
+}
+
+var (
+	collectionTemplate = template.Must(template.New("layout.html").Funcs(template.FuncMap{
+		"imageURL":     imageURL,
+		"postImageURL": postImageURL,
+	}).ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("collection.html"),
+		getTemplPath("posts.html"),
+		getTemplPath("post.html"),
+		getTemplPath("comment.html"),
+		getTemplPath("reply.html"),
+	))
+)
+
+func getCollection(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	user, ok := getCollectionOwner(w, r, me)
+	if !ok {
+		return
+	}
+
+	collection := Collection{}
+	err := db.Get(&collection, "SELECT * FROM `collections` WHERE `user_id` = ? AND `slug` = ?", user.ID, chi.URLParam(r, "slug"))
+	if err != nil || !collection.IsPublic && collection.UserID != me.ID {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// 削除された投稿やBANされたユーザーの投稿はJOINとdel_flgで自然に落ちる
+	results := []Post{}
+	args := append([]interface{}{collection.ID}, visiblePostsArgs(me)...)
+	err = db.Select(&results,
+		"SELECT p.id, p.user_id, p.body, p.mime, p.visibility, p.status, p.publish_at, p.created_at, "+
+			"u.account_name as `user.account_name`"+
+			" FROM `collection_posts` AS cp JOIN `posts` AS p ON (cp.post_id=p.id) JOIN `users` AS u ON (p.user_id=u.id) "+
+			"WHERE cp.collection_id = ? AND u.del_flg=0 AND "+publishedPostsCondition+" AND "+visiblePostsCondition+" AND "+unmutedPostsCondition+
+			" ORDER BY cp.position LIMIT ?",
+		append(args, me.ID, collectionPostsLimit)...)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	posts, err := makePosts(results, me, getCSRFToken(r), indexCommentsPerPost)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	collectionTemplate.Execute(w, struct {
+		User       User
+		Collection Collection
+		Posts      []Post
+		Me         User
+		CSRFToken  string
+	}{user, collection, posts, me, getCSRFToken(r)})
+}
+
+func postCollections(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	slug, name := r.FormValue("slug"), r.FormValue("name")
+	if !collectionSlugPattern.MatchString(slug) || name == "" {
+		session := getSession(r)
+		session.Values["notice"] = "URLは英小文字・数字・_・-のみ、名前は必須です"
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/@"+me.AccountName+"/collections", http.StatusFound)
+		return
+	}
+
+	isPublic := r.FormValue("is_public") == "1"
+
+	_, err := db.Exec("INSERT INTO `collections` (`user_id`, `slug`, `name`, `is_public`) VALUES (?,?,?,?)",
+		me.ID, slug, name, isPublic)
+	if err != nil {
+		session := getSession(r)
+		session.Values["notice"] = "同じURLのコレクションがすでにあります"
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/@"+me.AccountName+"/collections", http.StatusFound)
+		return
+	}
+
+	http.Redirect(w, r, "/@"+me.AccountName+"/collections/"+slug, http.StatusFound)
+}
+
+// コレクションを編集するハンドラの共通処理
+// ログインを確認し、URLのslugからログインユーザーのコレクションと対象の投稿IDを返す
+func getEditingCollection(w http.ResponseWriter, r *http.Request) (User, Collection, int, bool) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return User{}, Collection{}, 0, false
+	}
+
+	collection := Collection{}
+	err := db.Get(&collection, "SELECT * FROM `collections` WHERE `user_id` = ? AND `slug` = ?", me.ID, chi.URLParam(r, "slug"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return User{}, Collection{}, 0, false
+	}
+
+	postID, err := strconv.Atoi(r.FormValue("post_id"))
+	if err != nil {
+		log.Print("post_idは整数のみです")
+		w.WriteHeader(http.StatusBadRequest)
+		return User{}, Collection{}, 0, false
+	}
+
+	return me, collection, postID, true
+}
+
+func collectionURL(me User, c Collection) string {
+	return "/@" + me.AccountName + "/collections/" + c.Slug
+}
+
+func postCollectionAdd(w http.ResponseWriter, r *http.Request) {
+	me, collection, postID, ok := getEditingCollection(w, r)
+	if !ok {
+		return
+	}
+
+	post := Post{}
+	err := db.Get(&post, "SELECT `id`, `user_id`, `visibility`, `status` FROM `posts` WHERE `id` = ?", postID)
+	if err != nil || !canViewPost(me, post) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	_, err = db.Exec(
+		"INSERT IGNORE INTO `collection_posts` (`collection_id`, `post_id`, `position`) "+
+			"SELECT ?, ?, COALESCE(MAX(`position`), 0) + 1 FROM `collection_posts` WHERE `collection_id` = ?",
+		collection.ID, postID, collection.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	http.Redirect(w, r, collectionURL(me, collection), http.StatusFound)
+}
+
+func postCollectionRemove(w http.ResponseWriter, r *http.Request) {
+	me, collection, postID, ok := getEditingCollection(w, r)
+	if !ok {
+		return
+	}
+
+	_, err := db.Exec("DELETE FROM `collection_posts` WHERE `collection_id` = ? AND `post_id` = ?", collection.ID, postID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	http.Redirect(w, r, collectionURL(me, collection), http.StatusFound)
+}
+
+// 指定した投稿を一つ前(up)または一つ後(down)の投稿と入れ替える
+func postCollectionMove(w http.ResponseWriter, r *http.Request) {
+	me, collection, postID, ok := getEditingCollection(w, r)
+	if !ok {
+		return
+	}
+
+	query := "SELECT `post_id`, `position` FROM `collection_posts` WHERE `collection_id` = ? AND `position` < ? ORDER BY `position` DESC LIMIT 1 FOR UPDATE"
+	if r.FormValue("direction") == "down" {
+		query = "SELECT `post_id`, `position` FROM `collection_posts` WHERE `collection_id` = ? AND `position` > ? ORDER BY `position` LIMIT 1 FOR UPDATE"
+	}
+
+	type item struct {
+		PostID   int `db:"post_id"`
+		Position int `db:"position"`
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	defer tx.Rollback()
+
+	target := item{}
+	err = tx.Get(&target, "SELECT `post_id`, `position` FROM `collection_posts` WHERE `collection_id` = ? AND `post_id` = ? FOR UPDATE", collection.ID, postID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	neighbor := item{}
+	err = tx.Get(&neighbor, query, collection.ID, target.Position)
+	if err == nil {
+		update := "UPDATE `collection_posts` SET `position` = ? WHERE `collection_id` = ? AND `post_id` = ?"
+		if _, err := tx.Exec(update, neighbor.Position, collection.ID, target.PostID); err != nil {
+			log.Print(err)
+			return
+		}
+		if _, err := tx.Exec(update, target.Position, collection.ID, neighbor.PostID); err != nil {
+			log.Print(err)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			log.Print(err)
+			return
+		}
+	}
+
+	http.Redirect(w, r, collectionURL(me, collection), http.StatusFound)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommentsTemplateCursor(t *testing.T) {
+	createdAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.FixedZone("JST", 9*60*60))
+	comments := []Comment{{ID: 10, CreatedAt: createdAt, User: User{AccountName: "mary"}, Comment: "hello"}}
+
+	render := func(data interface{}) string {
+		t.Helper()
+		var b strings.Builder
+		if err := commentsTemplate.Execute(&b, data); err != nil {
+			t.Fatal(err)
+		}
+		return b.String()
+	}
+
+	out := render(struct {
+		Comments []Comment
+		HasMore  bool
+		Next     commentCursor
+	}{comments, true, commentCursor{ID: 10, CreatedAt: createdAt}})
+	if !strings.Contains(out, `data-max-created-at="2024-01-02T03:04:05&#43;09:00"`) || !strings.Contains(out, `data-max-id="10"`) {
+		t.Errorf("cursor is missing:\n%s", out)
+	}
+
+	// 最後のページや、すべてミュートしていて空のページでも一覧の要素は返す
+	out = render(struct {
+		Comments []Comment
+		HasMore  bool
+		Next     commentCursor
+	}{[]Comment{}, false, commentCursor{}})
+	if !strings.Contains(out, `class="isu-comments"`) || strings.Contains(out, "data-max-id") {
+		t.Errorf("unexpected last page:\n%s", out)
+	}
+}
+
+func TestRepliesTemplateCursor(t *testing.T) {
+	createdAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.FixedZone("JST", 9*60*60))
+	reply := Comment{ID: 11, ParentID: 10, CreatedAt: createdAt, User: User{AccountName: "bob"}, Comment: "hi"}
+
+	// 読んでいない返信があるスレッドには「以前の返信を見る」を出す
+	var b strings.Builder
+	err := commentsTemplate.Execute(&b, struct {
+		Comments []Comment
+		HasMore  bool
+		Next     commentCursor
+	}{[]Comment{{
+		ID: 10, CreatedAt: createdAt, User: User{AccountName: "mary"}, Comment: "hello",
+		Replies:            []Comment{reply},
+		HasOlderReplies:    true,
+		OlderRepliesCursor: commentCursor{ID: 11, CreatedAt: createdAt},
+	}}, false, commentCursor{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), `class="isu-reply-more" data-comment-id="10"`) || !strings.Contains(b.String(), `data-max-id="11"`) {
+		t.Errorf("reply cursor is missing:\n%s", b.String())
+	}
+
+	b.Reset()
+	err = repliesTemplate.Execute(&b, struct {
+		Replies []Comment
+		HasMore bool
+		Next    commentCursor
+	}{[]Comment{reply}, false, commentCursor{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), `id="cid_11"`) || strings.Contains(b.String(), "data-max-id") {
+		t.Errorf("unexpected last page of replies:\n%s", b.String())
+	}
+}
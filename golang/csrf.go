@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// JSON APIなどフォームを使わないリクエストはこのヘッダーでトークンを送る
+const csrfHeader = "X-CSRF-Token"
+
+// 未ログインのセッションにもトークンを発行する。ログイン画面などのフォームで使う
+func issueCSRFToken(w http.ResponseWriter, r *http.Request) string {
+	if token := getCSRFToken(r); token != "" {
+		return token
+	}
+
+	session := getSession(r)
+	token := secureRandomStr(16)
+	session.Values["csrf_token"] = token
+	session.Save(r, w)
+	return token
+}
+
+// 状態を変えるリクエストはすべてトークンとリクエスト元を確認する
+func csrfProtect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			next.ServeHTTP(w, r)
+			return
+		}
+		// 違反の報告はブラウザが自動で送るもので、トークンを付けられない
+		if r.URL.Path == cspReportPath {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !isSameOrigin(r) {
+			log.Printf("csrf: cross-origin %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		}
+
+		token := r.Header.Get(csrfHeader)
+		if token == "" {
+			token = r.FormValue("csrf_token")
+		}
+		expected := getCSRFToken(r)
+		if expected == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// OriginかRefererがあれば自分のホストから来たものかを見る。どちらも送らないクライアントはトークンだけで判断する
+// nginxはポートを付けずにHostを渡すので、ホスト名だけを比べる
+func isSameOrigin(r *http.Request) bool {
+	source := r.Header.Get("Origin")
+	if source == "" || source == "null" {
+		source = r.Referer()
+	}
+	if source == "" {
+		return true
+	}
+
+	u, err := url.Parse(source)
+	if err != nil {
+		return false
+	}
+	return u.Hostname() == hostname(r.Host)
+}
+
+func hostname(hostport string) string {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return strings.Trim(hostport, "[]")
+	}
+	return host
+}
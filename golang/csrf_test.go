@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// トークンを発行するページと、アップロードを受けるページだけのハンドラ
+// アップロードはpostIndexと同じようにフォームを自分で読む
+func csrfTestHandler(uploaded *string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, issueCSRFToken(w, r))
+	})
+	mux.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseMultipartForm(UploadLimit)
+		if err != nil && err != http.ErrNotMultipart {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.MultipartForm != nil && len(r.MultipartForm.File["file"]) > 0 {
+			*uploaded = r.MultipartForm.File["file"][0].Filename
+		}
+	})
+	return csrfProtect(mux)
+}
+
+func newUploadRequest(t *testing.T, fields map[string]string) *http.Request {
+	t.Helper()
+
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	fw, err := mw.CreateFormFile("file", "a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write([]byte("\x89PNG"))
+	mw.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/upload", body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+func TestCSRFProtect(t *testing.T) {
+	useMemorySessionStore(t)
+
+	var uploaded string
+	h := csrfTestHandler(&uploaded)
+	b := newTestBrowser()
+	token := b.do(h, httptest.NewRequest(http.MethodGet, "/token", nil)).Body.String()
+
+	t.Run("token in header", func(t *testing.T) {
+		uploaded = ""
+		r := newUploadRequest(t, nil)
+		r.Header.Set(csrfHeader, token)
+		if w := b.do(h, r); w.Code != http.StatusOK || uploaded != "a.png" {
+			t.Fatalf("status %d, uploaded %q", w.Code, uploaded)
+		}
+	})
+
+	t.Run("token in form", func(t *testing.T) {
+		uploaded = ""
+		r := newUploadRequest(t, map[string]string{"csrf_token": token})
+		if w := b.do(h, r); w.Code != http.StatusOK || uploaded != "a.png" {
+			t.Fatalf("status %d, uploaded %q", w.Code, uploaded)
+		}
+	})
+
+	t.Run("wrong token", func(t *testing.T) {
+		r := newUploadRequest(t, map[string]string{"csrf_token": "wrong"})
+		if w := b.do(h, r); w.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("status %d", w.Code)
+		}
+	})
+
+	t.Run("no session", func(t *testing.T) {
+		r := newUploadRequest(t, map[string]string{"csrf_token": token})
+		if w := newTestBrowser().do(h, r); w.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("status %d", w.Code)
+		}
+	})
+
+	t.Run("cross origin", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(url.Values{"csrf_token": {token}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Origin", "https://evil.example.com")
+		if w := b.do(h, r); w.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("status %d", w.Code)
+		}
+	})
+}
+
+func TestIsSameOrigin(t *testing.T) {
+	for _, tc := range []struct {
+		host, origin, referer string
+		want                  bool
+	}{
+		{"example.com", "", "", true},
+		{"example.com", "https://example.com", "", true},
+		{"example.com:8080", "http://example.com", "", true},
+		{"example.com", "null", "https://example.com/posts/1", true},
+		{"example.com", "https://evil.example.com", "", false},
+		{"example.com", "", "https://evil.example.com/", false},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.Host = tc.host
+		if tc.origin != "" {
+			r.Header.Set("Origin", tc.origin)
+		}
+		if tc.referer != "" {
+			r.Header.Set("Referer", tc.referer)
+		}
+		if got := isSameOrigin(r); got != tc.want {
+			t.Errorf("host %q origin %q referer %q: got %v", tc.host, tc.origin, tc.referer, got)
+		}
+	}
+}
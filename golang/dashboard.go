@@ -0,0 +1,255 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+const (
+	dashboardCacheKey = "admin:stats"
+	dashboardInterval = 5 * time.Minute
+	// 日別の集計を出す日数
+	dashboardDays = 14
+	// 投稿数の多いユーザーを集計する期間
+	dashboardTopPostersWindow = 30 * 24 * time.Hour
+	dashboardTopPostersLimit  = 10
+	dashboardActionsLimit     = 20
+)
+
+type dailyCount struct {
+	Day    string `db:"day" json:"day"`
+	Count  int    `db:"count" json:"count"`
+	Images int    `db:"images" json:"images,omitempty"`
+}
+
+type topPoster struct {
+	AccountName string `db:"account_name" json:"account_name"`
+	Count       int    `db:"count" json:"count"`
+}
+
+type dashboardStats struct {
+	Users        int          `json:"users"`
+	Posts        int          `json:"posts"`
+	Comments     int          `json:"comments"`
+	Signups      []dailyCount `json:"signups"`
+	Uploads      []dailyCount `json:"uploads"`
+	ImageBytes   int64        `json:"image_bytes"`
+	DBBytes      int64        `json:"db_bytes"`
+	TopPosters   []topPoster  `json:"top_posters"`
+	CalculatedAt time.Time    `json:"calculated_at"`
+}
+
+type ModerationAction struct {
+	ID         int            `db:"id"`
+	AdminID    int            `db:"admin_id"`
+	Action     string         `db:"action"`
+	TargetType string         `db:"target_type"`
+	TargetID   int            `db:"target_id"`
+	ReportID   int            `db:"report_id"`
+	CreatedAt  time.Time      `db:"created_at"`
+	AdminName  sql.NullString `db:"admin_name"`
+}
+
+// 画像ディレクトリの合計サイズ
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// どれも全件を舐める重いクエリなので、リクエストのたびには実行せず定期的に計算しておく
+func computeDashboardStats() (dashboardStats, error) {
+	now := time.Now()
+	since := now.AddDate(0, 0, -dashboardDays+1)
+	since = time.Date(since.Year(), since.Month(), since.Day(), 0, 0, 0, 0, since.Location())
+
+	stats := dashboardStats{CalculatedAt: now}
+	counts := []struct {
+		dest  *int
+		query string
+	}{
+		{&stats.Users, "SELECT COUNT(*) FROM `users` WHERE `del_flg` = 0"},
+		{&stats.Posts, "SELECT COUNT(*) FROM `posts`"},
+		{&stats.Comments, "SELECT COUNT(*) FROM `comments`"},
+	}
+	for _, c := range counts {
+		if err := db.Get(c.dest, c.query); err != nil {
+			return dashboardStats{}, err
+		}
+	}
+
+	err := db.Select(&stats.Signups,
+		"SELECT DATE_FORMAT(`created_at`, '%Y-%m-%d') AS `day`, COUNT(*) AS `count` FROM `users` "+
+			"WHERE `created_at` >= ? GROUP BY `day` ORDER BY `day` DESC", since)
+	if err != nil {
+		return dashboardStats{}, err
+	}
+
+	err = db.Select(&stats.Uploads,
+		"SELECT DATE_FORMAT(p.created_at, '%Y-%m-%d') AS `day`, COUNT(DISTINCT p.id) AS `count`, COUNT(i.id) AS `images` "+
+			"FROM `posts` AS p LEFT JOIN `post_images` AS i ON (i.post_id=p.id) "+
+			"WHERE p.created_at >= ? GROUP BY `day` ORDER BY `day` DESC", since)
+	if err != nil {
+		return dashboardStats{}, err
+	}
+
+	err = db.Select(&stats.TopPosters,
+		"SELECT u.account_name, COUNT(*) AS `count` FROM `posts` AS p JOIN `users` AS u ON (p.user_id=u.id) "+
+			"WHERE p.created_at >= ? GROUP BY p.user_id ORDER BY `count` DESC LIMIT ?",
+		now.Add(-dashboardTopPostersWindow), dashboardTopPostersLimit)
+	if err != nil {
+		return dashboardStats{}, err
+	}
+
+	// 初期データの画像はDBのimgdataにも残っているので、DBのサイズも別に出す
+	err = db.Get(&stats.DBBytes,
+		"SELECT COALESCE(SUM(`data_length` + `index_length`), 0) FROM `information_schema`.`tables` WHERE `table_schema` = DATABASE()")
+	if err != nil {
+		return dashboardStats{}, err
+	}
+	for _, dir := range []string{imageDir, privateImageDir} {
+		size, err := dirSize(dir)
+		if err != nil {
+			return dashboardStats{}, err
+		}
+		stats.ImageBytes += size
+	}
+
+	return stats, nil
+}
+
+// このプロセスが最後に計算した値。memcacheから消えていても、計算し直さずにこれを出す
+var lastDashboardStats struct {
+	mu    sync.Mutex
+	stats *dashboardStats
+}
+
+// 計算し直してlastDashboardStatsとmemcacheに置く。lastDashboardStats.muを取ってから呼ぶ
+func storeDashboardStats() error {
+	stats, err := computeDashboardStats()
+	if err != nil {
+		return err
+	}
+	lastDashboardStats.stats = &stats
+
+	value, err := json.Marshal(stats)
+	if err != nil {
+		return err
+	}
+	return memcacheClient.Set(&memcache.Item{
+		Key:        dashboardCacheKey,
+		Value:      value,
+		Expiration: int32(dashboardInterval.Seconds() * 2),
+	})
+}
+
+func refreshDashboardStats() error {
+	lastDashboardStats.mu.Lock()
+	defer lastDashboardStats.mu.Unlock()
+
+	return storeDashboardStats()
+}
+
+// memcacheにないときは最後に計算した値を出し、まだ一度も計算していなければここで計算して置く
+// 同時に来ても計算するのは一つだけで、残りはその結果を使う
+func lastOrComputeDashboardStats() (dashboardStats, error) {
+	lastDashboardStats.mu.Lock()
+	defer lastDashboardStats.mu.Unlock()
+
+	if lastDashboardStats.stats == nil {
+		err := storeDashboardStats()
+		if lastDashboardStats.stats == nil {
+			return dashboardStats{}, err
+		}
+		if err != nil {
+			log.Print(err)
+		}
+	}
+	return *lastDashboardStats.stats, nil
+}
+
+func getDashboardStats() (dashboardStats, error) {
+	item, err := memcacheClient.Get(dashboardCacheKey)
+	if err == memcache.ErrCacheMiss {
+		return lastOrComputeDashboardStats()
+	}
+	if err != nil {
+		return dashboardStats{}, err
+	}
+
+	stats := dashboardStats{}
+	err = json.Unmarshal(item.Value, &stats)
+	if err != nil {
+		return dashboardStats{}, err
+	}
+	return stats, nil
+}
+
+// バイト数を読みやすい単位にする
+func humanBytes(n int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	f := float64(n)
+	i := 0
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	return strconv.FormatFloat(f, 'f', 1, 64) + " " + units[i]
+}
+
+var (
+	adminDashboardTemplate = template.Must(template.New("layout.html").Funcs(template.FuncMap{
+		"humanBytes": humanBytes,
+	}).ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("dashboard.html"),
+	))
+)
+
+func getAdminDashboard(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+
+	stats, err := getDashboardStats()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	// 管理操作の履歴は件数が少なく、直後に反映されてほしいのでキャッシュしない
+	actions := []ModerationAction{}
+	err = db.Select(&actions,
+		"SELECT m.*, u.account_name AS admin_name FROM `moderation_actions` AS m "+
+			"LEFT JOIN `users` AS u ON (m.admin_id=u.id) ORDER BY m.id DESC LIMIT ?",
+		dashboardActionsLimit)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	adminDashboardTemplate.Execute(w, struct {
+		Stats   dashboardStats
+		Actions []ModerationAction
+		Me      User
+	}{stats, actions, me})
+}
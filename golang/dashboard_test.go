@@ -0,0 +1,19 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// memcacheから消えても、集計をやり直さずに最後の値を出す
+// dbはテストでは使えないので、計算し直そうとすればpanicになる
+func TestGetDashboardStatsServesLastSnapshot(t *testing.T) {
+	useMemcachedStandIn(t)
+	t.Cleanup(func() { lastDashboardStats.stats = nil })
+
+	lastDashboardStats.stats = &dashboardStats{Users: 3, CalculatedAt: time.Now()}
+	stats, err := getDashboardStats()
+	if err != nil || stats.Users != 3 {
+		t.Fatalf("stats = %+v, err = %v", stats, err)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	scheduledPostsInterval = 10 * time.Second
+	scheduledPostsBatch    = 100
+)
+
+// 下書きや予約投稿を公開する
+// 状態の更新を条件付きのUPDATEで行うので、再起動をまたいだり複数のプロセスから同時に呼ばれても
+// 公開後の処理を行うのは最初に更新できた一回だけになる
+func publishDraft(pid int) (bool, error) {
+	result, err := db.Exec(
+		"UPDATE `posts` SET `status` = ?, `publish_at` = NULL, `created_at` = NOW() WHERE `id` = ? AND `status` != ?",
+		postStatusPublished, pid, postStatusPublished)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if n == 0 {
+		return false, nil
+	}
+
+	post := Post{}
+	err = db.Get(&post,
+		"SELECT p.id, p.user_id, p.body, p.mime, p.visibility, p.status, p.publish_at, p.created_at, "+
+			"u.account_name as `user.account_name`"+
+			" FROM `posts` AS p JOIN `users` AS u ON (p.user_id=u.id) WHERE p.id = ?", pid)
+	if err != nil {
+		return true, err
+	}
+
+	images, err := selectPostImages([]Post{post})
+	if err != nil {
+		return true, err
+	}
+	post.Images = images[post.ID]
+
+	// 全体公開になった投稿の画像はnginxから配信される場所に移す
+	// 移動が終わるまではgetImageが非公開側のファイルを返す
+	if postImageDir(post) == imageDir {
+		for _, img := range post.Images {
+			err := os.Rename(postImageFilename(privateImageDir, img), postImageFilename(imageDir, img))
+			if err != nil {
+				log.Print(err)
+			}
+		}
+	}
+
+	publishPost(post)
+
+	return true, nil
+}
+
+func publishScheduledPosts() error {
+	ids := []int{}
+	err := db.Select(&ids,
+		"SELECT `id` FROM `posts` WHERE `status` = ? AND `publish_at` <= ? ORDER BY `publish_at` LIMIT ?",
+		postStatusScheduled, time.Now(), scheduledPostsBatch)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		_, err := publishDraft(id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+var (
+	draftsTemplate = template.Must(template.ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("drafts.html")),
+	)
+)
+
+func getDrafts(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	posts := []Post{}
+	err := db.Select(&posts,
+		"SELECT `id`, `user_id`, `body`, `mime`, `visibility`, `status`, `publish_at`, `created_at` "+
+			"FROM `posts` WHERE `user_id` = ? AND `status` != ? ORDER BY `created_at` DESC",
+		me.ID, postStatusPublished)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	draftsTemplate.Execute(w, struct {
+		Posts     []Post
+		Me        User
+		CSRFToken string
+	}{posts, me, getCSRFToken(r)})
+}
+
+func postDraftsPublish(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	pid, err := strconv.Atoi(r.FormValue("post_id"))
+	if err != nil {
+		log.Print("post_idは整数のみです")
+		return
+	}
+
+	owner := 0
+	err = db.Get(&owner, "SELECT `user_id` FROM `posts` WHERE `id` = ?", pid)
+	if err != nil || owner != me.ID {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	_, err = publishDraft(pid)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	http.Redirect(w, r, "/posts/"+strconv.Itoa(pid), http.StatusFound)
+}
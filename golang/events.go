@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// 再接続時にLast-Event-IDから再送できるイベントの件数
+	eventHistorySize = 256
+	// 購読者ごとのバッファ。溢れた購読者は切断して再接続させる
+	eventSubscriberBuffer = 32
+	eventKeepAlive        = 30 * time.Second
+)
+
+const (
+	eventTypePost    = "post"
+	eventTypeComment = "comment"
+)
+
+// Postはコメントのイベントでもコメント先の投稿を指す
+type timelineEvent struct {
+	ID      int64
+	Type    string
+	Post    Post
+	Comment Comment
+}
+
+// 新しい投稿やコメントをSSEの購読者に配信するプロセス内のpub/sub
+type eventBroker struct {
+	mu          sync.Mutex
+	lastID      int64
+	history     []timelineEvent
+	subscribers map[chan timelineEvent]struct{}
+}
+
+var broker = newEventBroker()
+
+func newEventBroker() *eventBroker {
+	return &eventBroker{
+		// 再起動前のIDで再接続してきたクライアントに履歴をすべて送れるよう、
+		// 起動時刻を起点にIDを振る
+		lastID:      time.Now().UnixNano(),
+		subscribers: map[chan timelineEvent]struct{}{},
+	}
+}
+
+func (b *eventBroker) Publish(ev timelineEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastID++
+	ev.ID = b.lastID
+
+	b.history = append(b.history, ev)
+	if len(b.history) > eventHistorySize {
+		b.history = b.history[len(b.history)-eventHistorySize:]
+	}
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- ev:
+		default:
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// lastEventIDより後の履歴と、以降のイベントを受け取るチャネルを返す
+func (b *eventBroker) Subscribe(lastEventID int64) (chan timelineEvent, []timelineEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	backlog := []timelineEvent{}
+	if lastEventID > 0 {
+		for _, ev := range b.history {
+			if ev.ID > lastEventID {
+				backlog = append(backlog, ev)
+			}
+		}
+	}
+
+	ch := make(chan timelineEvent, eventSubscriberBuffer)
+	b.subscribers[ch] = struct{}{}
+	return ch, backlog
+}
+
+func (b *eventBroker) Unsubscribe(ch chan timelineEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subscribers[ch]; ok {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+func publishPost(p Post) {
+	broker.Publish(timelineEvent{Type: eventTypePost, Post: p})
+}
+
+// 公開範囲の確認に使うので、コメント先の投稿も一緒に渡す
+func publishComment(p Post, c Comment) {
+	broker.Publish(timelineEvent{Type: eventTypeComment, Post: p, Comment: c})
+}
+
+// CSRFトークンは購読者ごとに異なるので、HTMLは配信時に組み立てる
+func renderEvent(ev timelineEvent, csrfToken string) ([]byte, error) {
+	var buf bytes.Buffer
+	payload := struct {
+		PostID    int    `json:"post_id"`
+		CommentID int    `json:"comment_id,omitempty"`
+		ParentID  int    `json:"parent_id,omitempty"`
+		HTML      string `json:"html"`
+	}{}
+
+	switch ev.Type {
+	case eventTypePost:
+		p := ev.Post
+		p.CSRFToken = csrfToken
+		err := postsTemplate.ExecuteTemplate(&buf, "post.html", p)
+		if err != nil {
+			return nil, err
+		}
+		payload.PostID = p.ID
+	case eventTypeComment:
+		c := ev.Comment
+		c.CSRFToken = csrfToken
+		name := "comment.html"
+		if c.ParentID != 0 {
+			name = "reply.html"
+		}
+		err := postsTemplate.ExecuteTemplate(&buf, name, c)
+		if err != nil {
+			return nil, err
+		}
+		payload.PostID = c.PostID
+		payload.CommentID = c.ID
+		payload.ParentID = c.ParentID
+	default:
+		return nil, fmt.Errorf("unknown event type: %s", ev.Type)
+	}
+
+	payload.HTML = buf.String()
+	return json.Marshal(payload)
+}
+
+func getEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	lastEventID, _ := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64)
+	ch, backlog := broker.Subscribe(lastEventID)
+	defer broker.Unsubscribe(ch)
+
+	me := getSessionUser(r)
+	muted := mutedUserIDs(me)
+	csrfToken := getCSRFToken(r)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// nginxでバッファリングされないようにする
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(ev timelineEvent) error {
+		if !canViewPost(me, ev.Post) {
+			return nil
+		}
+		// ミュートしている相手の投稿やコメントは配信しない
+		if ev.Type == eventTypePost && muted[ev.Post.UserID] ||
+			ev.Type == eventTypeComment && muted[ev.Comment.UserID] {
+			return nil
+		}
+		data, err := renderEvent(ev, csrfToken)
+		if err != nil {
+			log.Print(err)
+			return nil
+		}
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, data)
+		return err
+	}
+
+	for _, ev := range backlog {
+		if err := send(ev); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(eventKeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-ch:
+			if !ok {
+				return
+			}
+			if err := send(ev); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
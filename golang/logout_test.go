@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// ログイン済みのセッションを作るページと、セッションのユーザーIDを返すページを加えたハンドラ
+// ユーザーの取得にDBを使わないよう、getLogoutにはコンテキストでユーザーを渡す
+func logoutTestHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login-as", func(w http.ResponseWriter, r *http.Request) {
+		session := getSession(r)
+		session.Values["user_id"] = 1
+		session.Save(r, w)
+		fmt.Fprint(w, issueCSRFToken(w, r))
+	})
+	mux.HandleFunc("/whoami", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, getSession(r).Values["user_id"])
+	})
+	mux.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			postLogout(w, r)
+			return
+		}
+		ctx := context.WithValue(r.Context(), sessionUserKey{}, User{ID: 1, AccountName: "mary"})
+		getLogout(w, r.WithContext(ctx))
+	})
+	return csrfProtect(mux)
+}
+
+func TestLogout(t *testing.T) {
+	useMemorySessionStore(t)
+	h := logoutTestHandler()
+	b := newTestBrowser()
+	token := b.do(h, httptest.NewRequest(http.MethodGet, "/login-as", nil)).Body.String()
+
+	whoami := func() string {
+		return b.do(h, httptest.NewRequest(http.MethodGet, "/whoami", nil)).Body.String()
+	}
+	postLogoutForm := func(values url.Values, origin string) int {
+		r := httptest.NewRequest(http.MethodPost, "/logout", strings.NewReader(values.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		return b.do(h, r).Code
+	}
+
+	// 別のサイトの画像タグなどで開かれても、確認画面を出すだけでログアウトしない
+	w := b.do(h, httptest.NewRequest(http.MethodGet, "/logout", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `method="post" action="/logout"`) {
+		t.Fatalf("GET /logout: status %d", w.Code)
+	}
+	if whoami() != "1" {
+		t.Fatal("GET /logout must not end the session")
+	}
+
+	if code := postLogoutForm(url.Values{}, ""); code != http.StatusUnprocessableEntity {
+		t.Fatalf("POST without a token: status %d", code)
+	}
+	if code := postLogoutForm(url.Values{"csrf_token": {token}}, "https://evil.example.com"); code != http.StatusUnprocessableEntity {
+		t.Fatalf("cross-site POST: status %d", code)
+	}
+	if whoami() != "1" {
+		t.Fatal("a rejected POST must not end the session")
+	}
+
+	if code := postLogoutForm(url.Values{"csrf_token": {token}}, ""); code != http.StatusFound {
+		t.Fatalf("POST with the token: status %d", code)
+	}
+	if got := whoami(); got != "<nil>" {
+		t.Fatalf("session still has user_id %q after logout", got)
+	}
+}
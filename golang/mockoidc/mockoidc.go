@@ -0,0 +1,337 @@
+// Package mockoidc は、外部アカウントでのログインを手元やテストで試すための最小限のOpenID Connectプロバイダ
+// 認可画面で入力したsubjectやメールアドレスで、そのままIDトークンを発行する。本番では使わないこと
+// 単体で動かすときはcmd/mockoidcを使う
+package mockoidc
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"html/template"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	keyID      = "mock"
+	codeTTL    = time.Minute
+	idTokenTTL = 5 * time.Minute
+)
+
+type authCode struct {
+	ClientID      string
+	RedirectURI   string
+	Nonce         string
+	CodeChallenge string
+	Claims        map[string]interface{}
+	ExpiresAt     time.Time
+}
+
+// Provider はhttp.Handlerとして動くプロバイダ
+type Provider struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	key          *rsa.PrivateKey
+
+	mux   *http.ServeMux
+	mu    sync.Mutex
+	codes map[string]authCode
+}
+
+// New はissuerのURLで動くプロバイダを作る。署名鍵は作るたびに新しくなる
+func New(issuer, clientID, clientSecret string) (*Provider, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Provider{
+		issuer:       strings.TrimSuffix(issuer, "/"),
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		key:          key,
+		codes:        map[string]authCode{},
+	}
+
+	p.mux = http.NewServeMux()
+	p.mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	p.mux.HandleFunc("/jwks", p.jwks)
+	p.mux.HandleFunc("/authorize", p.authorize)
+	p.mux.HandleFunc("/token", p.token)
+	return p, nil
+}
+
+func (p *Provider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mux.ServeHTTP(w, r)
+}
+
+// Issuer はIDトークンのissに入れるURL
+func (p *Provider) Issuer() string {
+	return p.issuer
+}
+
+var authorizeTemplate = template.Must(template.New("authorize").Parse(`<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="utf-8">
+    <title>Mock OIDC</title>
+  </head>
+  <body>
+    <h1>Mock OIDC</h1>
+    <p>{{ .RedirectURI }} にログインします</p>
+    <form method="post" action="/authorize">
+      {{ range $k, $v := .Params }}<input type="hidden" name="{{ $k }}" value="{{ $v }}">
+      {{ end }}
+      <div>subject <input type="text" name="sub" value="mock-user"></div>
+      <div>preferred_username <input type="text" name="preferred_username" value="mockuser"></div>
+      <div>email <input type="email" name="email" value="mockuser@example.com"></div>
+      <div><label><input type="checkbox" name="email_verified" value="1" checked> email_verified</label></div>
+      <div>
+        <input type="submit" name="action" value="login">
+        <input type="submit" name="action" value="cancel">
+      </div>
+    </form>
+  </body>
+</html>
+`))
+
+func randomString(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func tokenError(w http.ResponseWriter, status int, code, description string) {
+	writeJSON(w, status, map[string]string{"error": code, "error_description": description})
+}
+
+func (p *Provider) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                p.issuer,
+		"authorization_endpoint":                p.issuer + "/authorize",
+		"token_endpoint":                        p.issuer + "/token",
+		"jwks_uri":                              p.issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"scopes_supported":                      []string{"openid", "email", "profile"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (p *Provider) jwks(w http.ResponseWriter, r *http.Request) {
+	pub := p.key.PublicKey
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": keyID,
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+// 認可リクエストを確かめる。redirect_uriが使えないときは、リダイレクトせずにその場でエラーを出す
+func (p *Provider) checkAuthorizeRequest(w http.ResponseWriter, q url.Values) bool {
+	if q.Get("client_id") != p.clientID {
+		http.Error(w, "unknown client_id", http.StatusBadRequest)
+		return false
+	}
+	if u, err := url.Parse(q.Get("redirect_uri")); err != nil || !u.IsAbs() {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func redirectWith(w http.ResponseWriter, r *http.Request, redirectURI string, params url.Values) {
+	sep := "?"
+	if strings.Contains(redirectURI, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, redirectURI+sep+params.Encode(), http.StatusFound)
+}
+
+func (p *Provider) authorize(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !p.checkAuthorizeRequest(w, r.Form) {
+		return
+	}
+	redirectURI := r.Form.Get("redirect_uri")
+	state := r.Form.Get("state")
+
+	if r.Form.Get("response_type") != "code" {
+		redirectWith(w, r, redirectURI, url.Values{"error": {"unsupported_response_type"}, "state": {state}})
+		return
+	}
+	if !strings.Contains(" "+r.Form.Get("scope")+" ", " openid ") {
+		redirectWith(w, r, redirectURI, url.Values{"error": {"invalid_scope"}, "state": {state}})
+		return
+	}
+	if r.Form.Get("code_challenge_method") != "" && r.Form.Get("code_challenge_method") != "S256" {
+		redirectWith(w, r, redirectURI, url.Values{"error": {"invalid_request"}, "state": {state}})
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		params := map[string]string{}
+		for _, k := range []string{"client_id", "redirect_uri", "response_type", "scope", "state", "nonce", "code_challenge", "code_challenge_method"} {
+			params[k] = r.Form.Get(k)
+		}
+		authorizeTemplate.Execute(w, struct {
+			RedirectURI string
+			Params      map[string]string
+		}{redirectURI, params})
+		return
+	}
+
+	if r.Form.Get("action") == "cancel" {
+		redirectWith(w, r, redirectURI, url.Values{"error": {"access_denied"}, "state": {state}})
+		return
+	}
+
+	claims := map[string]interface{}{
+		"sub":            r.Form.Get("sub"),
+		"email":          r.Form.Get("email"),
+		"email_verified": r.Form.Get("email_verified") == "1",
+	}
+	if name := r.Form.Get("preferred_username"); name != "" {
+		claims["preferred_username"] = name
+	}
+
+	code := randomString(16)
+	p.mu.Lock()
+	p.codes[code] = authCode{
+		ClientID:      p.clientID,
+		RedirectURI:   redirectURI,
+		Nonce:         r.Form.Get("nonce"),
+		CodeChallenge: r.Form.Get("code_challenge"),
+		Claims:        claims,
+		ExpiresAt:     time.Now().Add(codeTTL),
+	}
+	p.mu.Unlock()
+
+	redirectWith(w, r, redirectURI, url.Values{"code": {code}, "state": {state}})
+}
+
+// client_secret_basicとclient_secret_postのどちらでも受け付ける
+func (p *Provider) authenticateClient(r *http.Request) bool {
+	id, secret, ok := r.BasicAuth()
+	if ok {
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	return id == p.clientID && subtle.ConstantTimeCompare([]byte(secret), []byte(p.clientSecret)) == 1
+}
+
+func (p *Provider) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		tokenError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	if !p.authenticateClient(r) {
+		tokenError(w, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		tokenError(w, http.StatusBadRequest, "unsupported_grant_type", "")
+		return
+	}
+
+	// 認可コードは一度しか使えない
+	p.mu.Lock()
+	code, ok := p.codes[r.PostForm.Get("code")]
+	delete(p.codes, r.PostForm.Get("code"))
+	p.mu.Unlock()
+
+	switch {
+	case !ok || time.Now().After(code.ExpiresAt):
+		tokenError(w, http.StatusBadRequest, "invalid_grant", "unknown or expired code")
+		return
+	case code.RedirectURI != r.PostForm.Get("redirect_uri"):
+		tokenError(w, http.StatusBadRequest, "invalid_grant", "redirect_uri mismatch")
+		return
+	case code.CodeChallenge != "":
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if base64.RawURLEncoding.EncodeToString(sum[:]) != code.CodeChallenge {
+			tokenError(w, http.StatusBadRequest, "invalid_grant", "code_verifier mismatch")
+			return
+		}
+	}
+
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss": p.issuer,
+		"aud": code.ClientID,
+		"iat": now.Unix(),
+		"exp": now.Add(idTokenTTL).Unix(),
+	}
+	if code.Nonce != "" {
+		claims["nonce"] = code.Nonce
+	}
+	for k, v := range code.Claims {
+		claims[k] = v
+	}
+	idToken, err := p.sign(claims)
+	if err != nil {
+		tokenError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": randomString(16),
+		"token_type":   "Bearer",
+		"expires_in":   int(idTokenTTL.Seconds()),
+		"id_token":     idToken,
+	})
+}
+
+func (p *Provider) sign(claims map[string]interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": keyID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
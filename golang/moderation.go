@@ -0,0 +1,345 @@
+package main
+
+import (
+	"database/sql"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	reportTargetPost    = "post"
+	reportTargetComment = "comment"
+	reportTargetUser    = "user"
+)
+
+const (
+	reportStatusOpen      = 0
+	reportStatusDismissed = 1
+	reportStatusRemoved   = 2
+	reportStatusBanned    = 3
+)
+
+const (
+	reportReasonLimit = 500
+	reportsPerPage    = 100
+)
+
+type Report struct {
+	ID           int           `db:"id"`
+	ReporterID   int           `db:"reporter_id"`
+	TargetType   string        `db:"target_type"`
+	TargetID     int           `db:"target_id"`
+	TargetUserID int           `db:"target_user_id"`
+	Reason       string        `db:"reason"`
+	Status       int           `db:"status"`
+	ResolvedBy   sql.NullInt64 `db:"resolved_by"`
+	ResolvedAt   sql.NullTime  `db:"resolved_at"`
+	CreatedAt    time.Time     `db:"created_at"`
+	// 管理画面の表示用
+	ReporterName   string `db:"reporter_name"`
+	TargetUserName string `db:"target_user_name"`
+	PostID         int    `db:"post_id"`
+	Content        string `db:"content"`
+}
+
+func (r Report) StatusLabel() string {
+	switch r.Status {
+	case reportStatusDismissed:
+		return "却下"
+	case reportStatusRemoved:
+		return "削除済み"
+	case reportStatusBanned:
+		return "BAN済み"
+	default:
+		return "未対応"
+	}
+}
+
+// 管理者の操作を記録する。通報から行った操作でなければreportIDは0
+func recordModerationAction(adminID int, action, targetType string, targetID, reportID int) {
+	_, err := db.Exec(
+		"INSERT INTO `moderation_actions` (`admin_id`, `action`, `target_type`, `target_id`, `report_id`) VALUES (?,?,?,?,?)",
+		adminID, action, targetType, targetID, reportID)
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+// 投稿と、それに紐づくコメント・画像・コレクションへの登録をまとめて消す
+func deletePost(pid int) error {
+	post := Post{}
+	err := db.Get(&post, "SELECT `id`, `user_id`, `mime`, `visibility`, `status` FROM `posts` WHERE `id` = ?", pid)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	images, err := selectPostImages([]Post{post})
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	queries := []string{
+		"DELETE FROM `notifications` WHERE `post_id` = ?",
+		"DELETE FROM `comments` WHERE `post_id` = ?",
+		"DELETE FROM `collection_posts` WHERE `post_id` = ?",
+		"DELETE FROM `post_images` WHERE `post_id` = ?",
+		"DELETE FROM `posts` WHERE `id` = ?",
+	}
+	for _, query := range queries {
+		if _, err := tx.Exec(query, pid); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	imgs := images[pid]
+	if len(imgs) == 0 {
+		imgs = []PostImage{{PostID: pid, Mime: post.Mime}}
+	}
+	for _, img := range imgs {
+		for _, dir := range []string{imageDir, privateImageDir} {
+			err := os.Remove(postImageFilename(dir, img))
+			if err != nil && !os.IsNotExist(err) {
+				log.Print(err)
+			}
+		}
+	}
+
+	invalidateCommentsCache(pid)
+	return nil
+}
+
+// コメントを消す。トップレベルのコメントなら返信もまとめて消す
+func deleteComment(cid int) error {
+	c := Comment{}
+	err := db.Get(&c, "SELECT `id`, `post_id`, `parent_id` FROM `comments` WHERE `id` = ?", cid)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM `notifications` WHERE `comment_id` IN (SELECT `id` FROM `comments` WHERE `id` = ? OR `parent_id` = ?)", cid, cid)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM `comments` WHERE `id` = ? OR `parent_id` = ?", cid, cid)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	invalidateCommentsCache(c.PostID)
+	return nil
+}
+
+func postReport(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	targetID, err := strconv.Atoi(r.FormValue("target_id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	reason := r.FormValue("reason")
+	if reason == "" || utf8.RuneCountInString(reason) > reportReasonLimit {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// 通報できるのは自分から見えている他人の投稿とコメントだけ
+	targetType := r.FormValue("target_type")
+	post := Post{}
+	targetUserID := 0
+	switch targetType {
+	case reportTargetPost:
+		err = db.Get(&post, "SELECT `id`, `user_id`, `visibility`, `status` FROM `posts` WHERE `id` = ?", targetID)
+		targetUserID = post.UserID
+	case reportTargetComment:
+		c := Comment{}
+		err = db.Get(&c, "SELECT `id`, `post_id`, `user_id` FROM `comments` WHERE `id` = ?", targetID)
+		if err == nil {
+			err = db.Get(&post, "SELECT `id`, `user_id`, `visibility`, `status` FROM `posts` WHERE `id` = ?", c.PostID)
+		}
+		targetUserID = c.UserID
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err != nil || !canViewPost(me, post) || targetUserID == me.ID {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	_, err = db.Exec(
+		"INSERT INTO `reports` (`reporter_id`, `target_type`, `target_id`, `target_user_id`, `reason`) VALUES (?,?,?,?,?)",
+		me.ID, targetType, targetID, targetUserID, reason)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	http.Redirect(w, r, "/posts/"+strconv.Itoa(post.ID), http.StatusFound)
+}
+
+var (
+	adminReportsTemplate = template.Must(template.ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("reports.html")),
+	)
+)
+
+func getAdminReports(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+
+	status, targetType, sort := r.URL.Query().Get("status"), r.URL.Query().Get("type"), r.URL.Query().Get("sort")
+
+	where := "1=1"
+	args := []interface{}{}
+	switch status {
+	case "all":
+	case "resolved":
+		where += " AND r.status != ?"
+		args = append(args, reportStatusOpen)
+	default:
+		status = "open"
+		where += " AND r.status = ?"
+		args = append(args, reportStatusOpen)
+	}
+	switch targetType {
+	case reportTargetPost, reportTargetComment:
+		where += " AND r.target_type = ?"
+		args = append(args, targetType)
+	default:
+		targetType = ""
+	}
+	order := "r.created_at DESC, r.id DESC"
+	if sort == "oldest" {
+		order = "r.created_at, r.id"
+	} else {
+		sort = "newest"
+	}
+
+	reports := []Report{}
+	err := db.Select(&reports,
+		"SELECT r.*, ru.account_name AS reporter_name, tu.account_name AS target_user_name, "+
+			"COALESCE(p.id, c.post_id, 0) AS post_id, COALESCE(p.body, c.comment, '') AS content "+
+			"FROM `reports` AS r JOIN `users` AS ru ON (r.reporter_id=ru.id) JOIN `users` AS tu ON (r.target_user_id=tu.id) "+
+			"LEFT JOIN `posts` AS p ON (r.target_type = 'post' AND p.id = r.target_id) "+
+			"LEFT JOIN `comments` AS c ON (r.target_type = 'comment' AND c.id = r.target_id) "+
+			"WHERE "+where+" ORDER BY "+order+" LIMIT ?",
+		append(args, reportsPerPage)...)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	adminReportsTemplate.Execute(w, struct {
+		Reports    []Report
+		Status     string
+		TargetType string
+		Sort       string
+		Me         User
+		CSRFToken  string
+		Flash      string
+	}{reports, status, targetType, sort, me, getCSRFToken(r), getFlash(w, r, "notice")})
+}
+
+// 通報への対応。action は dismiss(却下)、remove(内容を削除)、ban(投稿者をBAN)のいずれか
+// 同じ対象への未対応の通報もまとめて対応済みにする
+func postAdminReport(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+
+	report := Report{}
+	err := db.Get(&report, "SELECT * FROM `reports` WHERE `id` = ?", chi.URLParam(r, "id"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	action := r.FormValue("action")
+	status := reportStatusOpen
+	targetType, targetID := report.TargetType, report.TargetID
+	switch action {
+	case "dismiss":
+		status = reportStatusDismissed
+	case "remove":
+		if !me.Can(permDeleteContent) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		status = reportStatusRemoved
+		if report.TargetType == reportTargetPost {
+			err = deletePost(report.TargetID)
+		} else {
+			err = deleteComment(report.TargetID)
+		}
+	case "ban":
+		if !me.Can(permBan) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		status = reportStatusBanned
+		targetType, targetID = reportTargetUser, report.TargetUserID
+		err = banUser(me.ID, report.TargetUserID, "通報: "+report.Reason, sql.NullTime{})
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	// BANできなかった通報は未対応のまま残す
+	if err == errNotBannable {
+		session := getSession(r)
+		session.Values["notice"] = "投稿者は管理者かモデレーターのため、BANできません"
+		session.Save(r, w)
+		http.Redirect(w, r, "/admin/reports", http.StatusFound)
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	_, err = db.Exec(
+		"UPDATE `reports` SET `status` = ?, `resolved_by` = ?, `resolved_at` = NOW() "+
+			"WHERE `status` = ? AND (`id` = ? OR (`target_type` = ? AND `target_id` = ?))",
+		status, me.ID, reportStatusOpen, report.ID, report.TargetType, report.TargetID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	recordModerationAction(me.ID, action, targetType, targetID, report.ID)
+
+	http.Redirect(w, r, "/admin/reports", http.StatusFound)
+}
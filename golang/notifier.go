@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// パスワードの再設定などでユーザーに連絡する手段
+// ISUCONP_NOTIFIERで切り替える。既定はログに出すだけ
+type Notifier interface {
+	Notify(u User, subject, body string) error
+}
+
+var notifier Notifier = logNotifier{}
+
+var errNoEmail = errors.New("notifier: user has no email address")
+
+// ローカルでの確認用。内容をアプリのログにそのまま出す
+type logNotifier struct{}
+
+func (logNotifier) Notify(u User, subject, body string) error {
+	log.Printf("notify %s <%s>: %s\n%s", u.AccountName, u.Email.String, subject, body)
+	return nil
+}
+
+// ローカルでの確認用。内容をファイルに追記する
+type fileNotifier struct {
+	mu   sync.Mutex
+	path string
+}
+
+func (n *fileNotifier) Notify(u User, subject, body string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	f, err := os.OpenFile(n.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintf(f, "Date: %s\nTo: %s <%s>\nSubject: %s\n\n%s\n\n",
+		time.Now().Format(time.RFC1123Z), u.AccountName, u.Email.String, subject, body)
+	return err
+}
+
+// 登録されたメールアドレスに送る
+// 認証情報がなければ認証せずに送るので、MailHogのようなローカルのSMTPサーバーでも確認できる
+type smtpNotifier struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func (n smtpNotifier) Notify(u User, subject, body string) error {
+	if !u.Email.Valid || u.Email.String == "" {
+		return errNoEmail
+	}
+
+	msg := strings.Join([]string{
+		"From: " + n.from,
+		"To: " + u.Email.String,
+		"Subject: " + mime.QEncoding.Encode("UTF-8", subject),
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=UTF-8",
+		"",
+		body,
+	}, "\r\n")
+	return smtp.SendMail(n.addr, n.auth, n.from, []string{u.Email.String}, []byte(msg))
+}
+
+func loadNotifier() {
+	switch kind := os.Getenv("ISUCONP_NOTIFIER"); kind {
+	case "", "log":
+		notifier = logNotifier{}
+	case "file":
+		path := os.Getenv("ISUCONP_NOTIFIER_FILE")
+		if path == "" {
+			path = "notifications.log"
+		}
+		notifier = &fileNotifier{path: path}
+	case "smtp":
+		addr := os.Getenv("ISUCONP_SMTP_ADDRESS")
+		if addr == "" {
+			addr = "localhost:25"
+		}
+		from := os.Getenv("ISUCONP_SMTP_FROM")
+		if from == "" {
+			from = "noreply@localhost"
+		}
+		n := smtpNotifier{addr: addr, from: from}
+		if user := os.Getenv("ISUCONP_SMTP_USER"); user != "" {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				log.Fatalf("ISUCONP_SMTP_ADDRESS must be host:port: %s", addr)
+			}
+			n.auth = smtp.PlainAuth("", user, os.Getenv("ISUCONP_SMTP_PASSWORD"), host)
+		}
+		notifier = n
+	default:
+		log.Fatalf("ISUCONP_NOTIFIER must be log, file or smtp: %s", kind)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"mime"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 受け取ったメールを記録するだけのSMTPサーバー
+type smtpStandIn struct {
+	addr     string
+	messages chan smtpMessage
+}
+
+type smtpMessage struct {
+	from string
+	to   []string
+	data string
+}
+
+func startSMTPStandIn(t *testing.T) *smtpStandIn {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	s := &smtpStandIn{addr: ln.Addr().String(), messages: make(chan smtpMessage, 1)}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *smtpStandIn) serve(c net.Conn) {
+	defer c.Close()
+
+	br := bufio.NewReader(c)
+	fmt.Fprint(c, "220 localhost ESMTP\r\n")
+
+	msg := smtpMessage{}
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimRight(line, "\r\n"))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			fmt.Fprint(c, "250 localhost\r\n")
+		case strings.HasPrefix(cmd, "MAIL FROM:"):
+			msg.from = strings.Trim(strings.TrimRight(line, "\r\n")[len("MAIL FROM:"):], "<>")
+			fmt.Fprint(c, "250 ok\r\n")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			msg.to = append(msg.to, strings.Trim(strings.TrimRight(line, "\r\n")[len("RCPT TO:"):], "<>"))
+			fmt.Fprint(c, "250 ok\r\n")
+		case cmd == "DATA":
+			fmt.Fprint(c, "354 end with .\r\n")
+			var data strings.Builder
+			for {
+				l, err := br.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(l)
+			}
+			msg.data = data.String()
+			s.messages <- msg
+			msg = smtpMessage{}
+			fmt.Fprint(c, "250 queued\r\n")
+		case cmd == "QUIT":
+			fmt.Fprint(c, "221 bye\r\n")
+			return
+		default:
+			fmt.Fprint(c, "250 ok\r\n")
+		}
+	}
+}
+
+func TestSMTPNotifier(t *testing.T) {
+	s := startSMTPStandIn(t)
+	n := smtpNotifier{addr: s.addr, from: "noreply@localhost"}
+
+	u := User{AccountName: "mary", Email: sql.NullString{String: "mary@example.com", Valid: true}}
+	if err := n.Notify(u, "Iscogram パスワードの再設定", "https://example.com/password/reset/abc"); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := <-s.messages
+	if msg.from != "noreply@localhost" {
+		t.Errorf("MAIL FROM = %q", msg.from)
+	}
+	if len(msg.to) != 1 || msg.to[0] != "mary@example.com" {
+		t.Errorf("RCPT TO = %q", msg.to)
+	}
+	if !strings.Contains(msg.data, "To: mary@example.com\r\n") {
+		t.Errorf("missing To header:\n%s", msg.data)
+	}
+	if !strings.Contains(msg.data, "https://example.com/password/reset/abc") {
+		t.Errorf("missing body:\n%s", msg.data)
+	}
+
+	subject := ""
+	for _, line := range strings.Split(msg.data, "\r\n") {
+		if strings.HasPrefix(line, "Subject: ") {
+			subject = strings.TrimPrefix(line, "Subject: ")
+		}
+	}
+	decoded, err := new(mime.WordDecoder).DecodeHeader(subject)
+	if err != nil || decoded != "Iscogram パスワードの再設定" {
+		t.Errorf("Subject = %q (%q, %v)", subject, decoded, err)
+	}
+}
+
+func TestSMTPNotifierWithoutEmail(t *testing.T) {
+	n := smtpNotifier{addr: "127.0.0.1:1", from: "noreply@localhost"}
+	if err := n.Notify(User{AccountName: "mary"}, "subject", "body"); err != errNoEmail {
+		t.Fatalf("err = %v, want errNoEmail", err)
+	}
+}
+
+func TestFileNotifier(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notifications.log")
+	n := &fileNotifier{path: path}
+
+	u := User{AccountName: "mary", Email: sql.NullString{String: "mary@example.com", Valid: true}}
+	for _, body := range []string{"first", "second"} {
+		if err := n.Notify(u, "subject", body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "To: mary <mary@example.com>") ||
+		!strings.Contains(string(b), "first") || !strings.Contains(string(b), "second") {
+		t.Fatalf("unexpected file content:\n%s", b)
+	}
+}
+
+func TestPasswordResetURL(t *testing.T) {
+	t.Setenv("ISUCONP_BASE_URL", "")
+	if _, ok := passwordResetURL("abc"); ok {
+		t.Fatal("passwordResetURL should fail without ISUCONP_BASE_URL")
+	}
+
+	t.Setenv("ISUCONP_BASE_URL", "https://iscogram.example.com/")
+	got, ok := passwordResetURL("abc")
+	if !ok || got != "https://iscogram.example.com/password/reset/abc" {
+		t.Fatalf("passwordResetURL = %q, %v", got, ok)
+	}
+}
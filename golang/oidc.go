@@ -0,0 +1,851 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-sql-driver/mysql"
+)
+
+// 外部のOpenID Connectプロバイダのアカウントでログインする
+// ISUCONP_OIDC_PROVIDERSにカンマ区切りで名前を並べ、名前ごとに次の環境変数で設定する(googleならISUCONP_OIDC_GOOGLE_*)
+//
+//	ISSUER         issuerのURL。/.well-known/openid-configurationから各エンドポイントを調べる
+//	CLIENT_ID      クライアントID
+//	CLIENT_SECRET  クライアントシークレット。なければPKCEだけで認可コードを引き換える
+//	DISPLAY_NAME   ログイン画面に出す名前。なければ名前をそのまま使う
+//
+// コールバックのURLは{ISUCONP_BASE_URL}/oidc/{名前}/callbackになるので、ISUCONP_BASE_URLも必要
+// IDトークンの署名はRS256だけに対応している
+type oidcProvider struct {
+	Name         string
+	DisplayName  string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+
+	mu            sync.Mutex
+	config        *oidcConfig
+	keys          map[string]*rsa.PublicKey
+	keysFetchedAt time.Time
+}
+
+type oidcConfig struct {
+	Issuer                   string   `json:"issuer"`
+	AuthorizationEndpoint    string   `json:"authorization_endpoint"`
+	TokenEndpoint            string   `json:"token_endpoint"`
+	JWKSURI                  string   `json:"jwks_uri"`
+	TokenEndpointAuthMethods []string `json:"token_endpoint_auth_methods_supported"`
+}
+
+// 外部のアカウントとユーザーの対応。プロバイダの設定の名前は変わりうるので、issuerとsubjectで見分ける
+type UserIdentity struct {
+	ID        int       `db:"id"`
+	UserID    int       `db:"user_id"`
+	Issuer    string    `db:"issuer"`
+	Subject   string    `db:"subject"`
+	Email     string    `db:"email"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+const (
+	// プロバイダに移ってから戻ってくるまでの時間
+	oidcFlowTimeout = 10 * time.Minute
+	// 戻ってきてからアカウント名を決めるまでの時間
+	oidcSignupTimeout = 30 * time.Minute
+	// 知らない鍵IDが来たとき、鍵を取り直す間隔の下限
+	oidcKeysRefreshInterval = time.Minute
+	// IDトークンの有効期限を確かめるときに、時計のずれとして許す時間
+	oidcClockSkew = time.Minute
+)
+
+var (
+	oidcProviders  = []*oidcProvider{}
+	oidcHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+	oidcProviderNamePattern = regexp.MustCompile(`\A[a-z0-9]+\z`)
+)
+
+func loadOIDCProviders() {
+	names := os.Getenv("ISUCONP_OIDC_PROVIDERS")
+	if names == "" {
+		return
+	}
+	if _, ok := configuredBaseURL(); !ok {
+		log.Fatal("ISUCONP_BASE_URL is required to build the OIDC callback URL")
+	}
+
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if !oidcProviderNamePattern.MatchString(name) {
+			log.Fatalf("ISUCONP_OIDC_PROVIDERS must be lowercase letters and digits: %q", name)
+		}
+		prefix := "ISUCONP_OIDC_" + strings.ToUpper(name) + "_"
+		p := &oidcProvider{
+			Name:         name,
+			DisplayName:  os.Getenv(prefix + "DISPLAY_NAME"),
+			Issuer:       strings.TrimSuffix(os.Getenv(prefix+"ISSUER"), "/"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+		}
+		if p.Issuer == "" || p.ClientID == "" {
+			log.Fatalf("%sISSUER and %sCLIENT_ID are required", prefix, prefix)
+		}
+		if p.DisplayName == "" {
+			p.DisplayName = name
+		}
+		oidcProviders = append(oidcProviders, p)
+	}
+}
+
+func findOIDCProvider(name string) *oidcProvider {
+	for _, p := range oidcProviders {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+func findOIDCProviderByIssuer(issuer string) *oidcProvider {
+	for _, p := range oidcProviders {
+		if p.Issuer == issuer {
+			return p
+		}
+	}
+	return nil
+}
+
+func getJSON(rawURL string, dest interface{}) error {
+	resp, err := oidcHTTPClient.Get(rawURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", rawURL, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(dest)
+}
+
+// プロバイダが落ちていてもアプリは起動できるように、エンドポイントは最初に使うときに調べる
+func (p *oidcProvider) discover() (*oidcConfig, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.config != nil {
+		return p.config, nil
+	}
+
+	config := &oidcConfig{}
+	if err := getJSON(p.Issuer+"/.well-known/openid-configuration", config); err != nil {
+		return nil, err
+	}
+	if config.Issuer != p.Issuer {
+		return nil, fmt.Errorf("oidc: issuer mismatch: configured %q, discovered %q", p.Issuer, config.Issuer)
+	}
+	if config.AuthorizationEndpoint == "" || config.TokenEndpoint == "" || config.JWKSURI == "" {
+		return nil, fmt.Errorf("oidc: incomplete discovery document from %s", p.Issuer)
+	}
+	p.config = config
+	return config, nil
+}
+
+// IDトークンの署名を確かめる鍵。プロバイダが鍵を入れ替えたときのために、知らない鍵IDが来たら取り直す
+func (p *oidcProvider) publicKey(config *oidcConfig, kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.lookupKey(kid); ok {
+		return key, nil
+	}
+	if time.Since(p.keysFetchedAt) < oidcKeysRefreshInterval {
+		return nil, fmt.Errorf("oidc: unknown key id %q", kid)
+	}
+
+	jwks := struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}{}
+	if err := getJSON(config.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	p.keys = keys
+	p.keysFetchedAt = time.Now()
+
+	if key, ok := p.lookupKey(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("oidc: unknown key id %q", kid)
+}
+
+// 鍵IDのないトークンは、鍵が一つしかないときだけ受け付ける
+func (p *oidcProvider) lookupKey(kid string) (*rsa.PublicKey, bool) {
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+	key, ok := p.keys[kid]
+	return key, ok
+}
+
+// ログインを始めるときにセッションに入れておき、戻ってきたときに確かめる値
+type oidcFlow struct {
+	State        string
+	Nonce        string
+	CodeVerifier string
+}
+
+func (p *oidcProvider) authURL(config *oidcConfig, redirectURI string, flow oidcFlow) string {
+	challenge := sha256.Sum256([]byte(flow.CodeVerifier))
+
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", p.ClientID)
+	q.Set("redirect_uri", redirectURI)
+	q.Set("scope", "openid email profile")
+	q.Set("state", flow.State)
+	q.Set("nonce", flow.Nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(config.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return config.AuthorizationEndpoint + sep + q.Encode()
+}
+
+// IDトークンのクレームのうち、ここで使うもの
+type oidcClaims struct {
+	Issuer            string       `json:"iss"`
+	Subject           string       `json:"sub"`
+	Audience          oidcAudience `json:"aud"`
+	AuthorizedParty   string       `json:"azp"`
+	Expiry            int64        `json:"exp"`
+	IssuedAt          int64        `json:"iat"`
+	Nonce             string       `json:"nonce"`
+	Email             string       `json:"email"`
+	EmailVerified     interface{}  `json:"email_verified"`
+	PreferredUsername string       `json:"preferred_username"`
+}
+
+// audは文字列か文字列の配列のどちらかで送られてくる
+type oidcAudience []string
+
+func (a *oidcAudience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = oidcAudience{s}
+		return nil
+	}
+	var ss []string
+	if err := json.Unmarshal(b, &ss); err != nil {
+		return err
+	}
+	*a = ss
+	return nil
+}
+
+func (a oidcAudience) contains(clientID string) bool {
+	for _, aud := range a {
+		if aud == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// 確認済みのメールアドレス。プロバイダによってはemail_verifiedを文字列で送ってくる
+func (c oidcClaims) verifiedEmail() string {
+	if c.EmailVerified == true || c.EmailVerified == "true" {
+		return c.Email
+	}
+	return ""
+}
+
+// 認可コードをIDトークンに引き換え、検証したクレームを返す
+func (p *oidcProvider) exchange(config *oidcConfig, code, redirectURI string, flow oidcFlow) (oidcClaims, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURI)
+	form.Set("code_verifier", flow.CodeVerifier)
+
+	// client_secret_basicが標準なので、プロバイダがclient_secret_postにしか対応していないときだけ本文で送る
+	useBasic := p.ClientSecret != ""
+	if useBasic && len(config.TokenEndpointAuthMethods) > 0 {
+		useBasic = false
+		for _, m := range config.TokenEndpointAuthMethods {
+			if m == "client_secret_basic" {
+				useBasic = true
+			}
+		}
+	}
+	if !useBasic {
+		form.Set("client_id", p.ClientID)
+		if p.ClientSecret != "" {
+			form.Set("client_secret", p.ClientSecret)
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodPost, config.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return oidcClaims{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if useBasic {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	resp, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return oidcClaims{}, err
+	}
+	defer resp.Body.Close()
+
+	token := struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}{}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return oidcClaims{}, err
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return oidcClaims{}, fmt.Errorf("oidc: token endpoint returned %s", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK || token.IDToken == "" {
+		return oidcClaims{}, fmt.Errorf("oidc: token endpoint returned %s: %s %s", resp.Status, token.Error, token.ErrorDescription)
+	}
+
+	return p.verifyIDToken(config, token.IDToken, flow.Nonce, time.Now())
+}
+
+func (p *oidcProvider) verifyIDToken(config *oidcConfig, rawToken, nonce string, now time.Time) (oidcClaims, error) {
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return oidcClaims{}, errors.New("oidc: malformed id token")
+	}
+
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return oidcClaims{}, err
+	}
+	if header.Alg != "RS256" {
+		return oidcClaims{}, fmt.Errorf("oidc: unsupported signing algorithm %q", header.Alg)
+	}
+
+	key, err := p.publicKey(config, header.Kid)
+	if err != nil {
+		return oidcClaims{}, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return oidcClaims{}, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return oidcClaims{}, errors.New("oidc: invalid id token signature")
+	}
+
+	claims := oidcClaims{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return oidcClaims{}, err
+	}
+	switch {
+	case claims.Issuer != p.Issuer:
+		return oidcClaims{}, fmt.Errorf("oidc: unexpected issuer %q", claims.Issuer)
+	case !claims.Audience.contains(p.ClientID):
+		return oidcClaims{}, errors.New("oidc: id token is not issued for this client")
+	case len(claims.Audience) > 1 && claims.AuthorizedParty != p.ClientID:
+		return oidcClaims{}, errors.New("oidc: id token is authorized for another party")
+	case now.After(time.Unix(claims.Expiry, 0).Add(oidcClockSkew)):
+		return oidcClaims{}, errors.New("oidc: id token has expired")
+	case time.Unix(claims.IssuedAt, 0).After(now.Add(oidcClockSkew)):
+		return oidcClaims{}, errors.New("oidc: id token is issued in the future")
+	case subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1:
+		return oidcClaims{}, errors.New("oidc: nonce mismatch")
+	case claims.Subject == "":
+		return oidcClaims{}, errors.New("oidc: id token has no subject")
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, dest interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, dest)
+}
+
+// プロバイダに登録するコールバックのURL。Hostヘッダから組み立てると偽のHostで別のURLにできるので、設定の値だけを使う
+func oidcRedirectURI(p *oidcProvider) string {
+	base, _ := configuredBaseURL()
+	return base + "/oidc/" + p.Name + "/callback"
+}
+
+func clearOIDCFlow(session map[interface{}]interface{}) {
+	for _, key := range []string{"oidc_provider", "oidc_state", "oidc_nonce", "oidc_verifier", "oidc_started_at", "oidc_link_user_id"} {
+		delete(session, key)
+	}
+}
+
+func clearOIDCSignup(session map[interface{}]interface{}) {
+	for _, key := range []string{"oidc_signup_issuer", "oidc_signup_subject", "oidc_signup_email", "oidc_signup_name", "oidc_signup_at"} {
+		delete(session, key)
+	}
+}
+
+// プロバイダに移る。linkUserIDが0でなければ、戻ってきたときにそのユーザーに連携する
+func startOIDCFlow(w http.ResponseWriter, r *http.Request, p *oidcProvider, linkUserID int) {
+	config, err := p.discover()
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	flow := oidcFlow{
+		State:        secureRandomStr(16),
+		Nonce:        secureRandomStr(16),
+		CodeVerifier: secureRandomStr(32),
+	}
+
+	session := getSession(r)
+	session.Values["oidc_provider"] = p.Name
+	session.Values["oidc_state"] = flow.State
+	session.Values["oidc_nonce"] = flow.Nonce
+	session.Values["oidc_verifier"] = flow.CodeVerifier
+	session.Values["oidc_started_at"] = time.Now().UnixNano()
+	session.Values["oidc_link_user_id"] = linkUserID
+	session.Save(r, w)
+
+	http.Redirect(w, r, p.authURL(config, oidcRedirectURI(p), flow), http.StatusFound)
+}
+
+func getOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if isLogin(getSessionUser(r)) {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	p := findOIDCProvider(chi.URLParam(r, "provider"))
+	if p == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	startOIDCFlow(w, r, p, 0)
+}
+
+func getOIDCLink(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	p := findOIDCProvider(chi.URLParam(r, "provider"))
+	if p == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	startOIDCFlow(w, r, p, me.ID)
+}
+
+// プロバイダから戻ってきたリクエストを確かめ、認可コードをIDトークンのクレームに引き換える
+// stateは一度しか使えないように、確かめる前にセッションから消す
+// 失敗したときは、ユーザーに見せるメッセージを返す
+func finishOIDCFlow(w http.ResponseWriter, r *http.Request, p *oidcProvider) (oidcClaims, int, string) {
+	session := getSession(r)
+	providerName, _ := session.Values["oidc_provider"].(string)
+	state, _ := session.Values["oidc_state"].(string)
+	startedAt, _ := session.Values["oidc_started_at"].(int64)
+	linkUserID, _ := session.Values["oidc_link_user_id"].(int)
+	flow := oidcFlow{State: state}
+	flow.Nonce, _ = session.Values["oidc_nonce"].(string)
+	flow.CodeVerifier, _ = session.Values["oidc_verifier"].(string)
+	clearOIDCFlow(session.Values)
+	session.Save(r, w)
+
+	if state == "" || providerName != p.Name || time.Since(time.Unix(0, startedAt)) > oidcFlowTimeout ||
+		subtle.ConstantTimeCompare([]byte(state), []byte(r.FormValue("state"))) != 1 {
+		return oidcClaims{}, linkUserID, "認証の有効期限が切れました。もう一度お試しください"
+	}
+	if e := r.FormValue("error"); e != "" {
+		log.Printf("oidc: %s returned error: %s %s", p.Name, e, r.FormValue("error_description"))
+		return oidcClaims{}, linkUserID, p.DisplayName + "での認証がキャンセルされました"
+	}
+
+	config, err := p.discover()
+	if err != nil {
+		log.Print(err)
+		return oidcClaims{}, linkUserID, p.DisplayName + "での認証に失敗しました"
+	}
+	claims, err := p.exchange(config, r.FormValue("code"), oidcRedirectURI(p), flow)
+	if err != nil {
+		log.Print(err)
+		return oidcClaims{}, linkUserID, p.DisplayName + "での認証に失敗しました"
+	}
+	return claims, linkUserID, ""
+}
+
+func getOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	p := findOIDCProvider(chi.URLParam(r, "provider"))
+	if p == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	claims, linkUserID, message := finishOIDCFlow(w, r, p)
+	failed := func(message string) {
+		session := getSession(r)
+		session.Values["notice"] = message
+		session.Save(r, w)
+
+		if linkUserID != 0 {
+			http.Redirect(w, r, "/settings/connections", http.StatusFound)
+		} else {
+			http.Redirect(w, r, "/login", http.StatusFound)
+		}
+	}
+	if message != "" {
+		failed(message)
+		return
+	}
+
+	if linkUserID != 0 {
+		linkOIDCIdentity(w, r, p, claims, linkUserID)
+		return
+	}
+
+	u := User{}
+	err := db.Get(&u, "SELECT u.* FROM `users` AS u JOIN `user_identities` AS i ON (i.user_id=u.id) WHERE i.issuer = ? AND i.subject = ?",
+		claims.Issuer, claims.Subject)
+	if errors.Is(err, sql.ErrNoRows) {
+		// 初めてのログインなので、アカウント名を決めてもらってから登録する
+		session := getSession(r)
+		session.Values["oidc_signup_issuer"] = claims.Issuer
+		session.Values["oidc_signup_subject"] = claims.Subject
+		session.Values["oidc_signup_email"] = claims.verifiedEmail()
+		session.Values["oidc_signup_name"] = suggestAccountName(claims)
+		session.Values["oidc_signup_at"] = time.Now().UnixNano()
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/oidc/signup", http.StatusFound)
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	if u.DelFlg != 0 {
+		failed("このアカウントではログインできません")
+		return
+	}
+
+	completeLogin(w, r, u)
+}
+
+// ログイン中のユーザーに外部のアカウントを連携する
+// 同じプロバイダのアカウントは一つまでで、他のユーザーに連携済みのアカウントは使えない
+func linkOIDCIdentity(w http.ResponseWriter, r *http.Request, p *oidcProvider, claims oidcClaims, linkUserID int) {
+	me := getSessionUser(r)
+	if !isLogin(me) || me.ID != linkUserID {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	message := p.DisplayName + "のアカウントを連携しました"
+	_, err := db.Exec("INSERT INTO `user_identities` (`user_id`, `issuer`, `subject`, `email`) VALUES (?,?,?,?)",
+		me.ID, claims.Issuer, claims.Subject, claims.verifiedEmail())
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) && mysqlErr.Number == 1062 {
+		message = "この" + p.DisplayName + "のアカウントは連携できません。すでに連携済みか、他のユーザーが使っています"
+	} else if err != nil {
+		log.Print(err)
+		return
+	}
+
+	redirectConnections(w, r, message)
+}
+
+var oidcAccountNameInvalidChars = regexp.MustCompile(`[^0-9a-zA-Z_]`)
+
+// アカウント名の候補。preferred_usernameかメールアドレスの@より前から、使えない文字を除いて作る
+func suggestAccountName(claims oidcClaims) string {
+	name := claims.PreferredUsername
+	if name == "" {
+		name, _, _ = strings.Cut(claims.Email, "@")
+	}
+	return oidcAccountNameInvalidChars.ReplaceAllString(name, "")
+}
+
+// アカウント名を決めるのを待っている、外部のアカウント
+func getOIDCSignup(r *http.Request) (UserIdentity, string, bool) {
+	session := getSession(r)
+	issuer, _ := session.Values["oidc_signup_issuer"].(string)
+	subject, _ := session.Values["oidc_signup_subject"].(string)
+	at, _ := session.Values["oidc_signup_at"].(int64)
+	if issuer == "" || subject == "" || time.Since(time.Unix(0, at)) > oidcSignupTimeout {
+		return UserIdentity{}, "", false
+	}
+
+	email, _ := session.Values["oidc_signup_email"].(string)
+	name, _ := session.Values["oidc_signup_name"].(string)
+	return UserIdentity{Issuer: issuer, Subject: subject, Email: email}, name, true
+}
+
+var (
+	oidcSignupTemplate = template.Must(template.ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("oidc_signup.html")),
+	)
+	connectionsTemplate = template.Must(template.ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("connections.html")),
+	)
+)
+
+func getOIDCSignupPage(w http.ResponseWriter, r *http.Request) {
+	if isLogin(getSessionUser(r)) {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	identity, name, ok := getOIDCSignup(r)
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	providerName := identity.Issuer
+	if p := findOIDCProviderByIssuer(identity.Issuer); p != nil {
+		providerName = p.DisplayName
+	}
+
+	csrfToken := issueCSRFToken(w, r)
+	oidcSignupTemplate.Execute(w, struct {
+		Me           User
+		Flash        string
+		CSRFToken    string
+		ProviderName string
+		AccountName  string
+	}{User{}, getFlash(w, r, "notice"), csrfToken, providerName, name})
+}
+
+func postOIDCSignup(w http.ResponseWriter, r *http.Request) {
+	if isLogin(getSessionUser(r)) {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	identity, _, ok := getOIDCSignup(r)
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	failed := func(message string) {
+		session := getSession(r)
+		session.Values["notice"] = message
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/oidc/signup", http.StatusFound)
+	}
+
+	accountName := r.FormValue("account_name")
+	if !validateAccountName(accountName) {
+		failed("アカウント名は3文字以上である必要があります")
+		return
+	}
+
+	exists := 0
+	// ユーザーが存在しない場合はエラーになるのでエラーチェックはしない
+	db.Get(&exists, "SELECT 1 FROM users WHERE `account_name` = ?", accountName)
+	if exists == 1 {
+		failed("アカウント名がすでに使われています")
+		return
+	}
+
+	// パスワードは持たないので、パスワードでのログインはできない
+	var email interface{}
+	if identity.Email != "" {
+		email = identity.Email
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("INSERT INTO `users` (`account_name`, `passhash`, `email`) VALUES (?,'',?)", accountName, email)
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) && mysqlErr.Number == 1062 {
+		failed("アカウント名がすでに使われています")
+		return
+	} else if err != nil {
+		log.Print(err)
+		return
+	}
+	uid, err := result.LastInsertId()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	_, err = tx.Exec("INSERT INTO `user_identities` (`user_id`, `issuer`, `subject`, `email`) VALUES (?,?,?,?)",
+		uid, identity.Issuer, identity.Subject, identity.Email)
+	if errors.As(err, &mysqlErr) && mysqlErr.Number == 1062 {
+		// 別のタブで先に登録が済んでいる
+		session := getSession(r)
+		clearOIDCSignup(session.Values)
+		session.Values["notice"] = "このアカウントはすでに登録されています。もう一度ログインしてください"
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	} else if err != nil {
+		log.Print(err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Print(err)
+		return
+	}
+
+	session := getSession(r)
+	clearOIDCSignup(session.Values)
+	session.Save(r, w)
+	startLoginSession(w, r, uid)
+
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// 連携の設定画面に出す、プロバイダごとの状態
+type oidcConnection struct {
+	Provider *oidcProvider
+	Identity *UserIdentity
+}
+
+func redirectConnections(w http.ResponseWriter, r *http.Request, message string) {
+	session := getSession(r)
+	session.Values["notice"] = message
+	session.Save(r, w)
+
+	http.Redirect(w, r, "/settings/connections", http.StatusFound)
+}
+
+func getConnections(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	identities := []UserIdentity{}
+	err := db.Select(&identities, "SELECT * FROM `user_identities` WHERE `user_id` = ? ORDER BY `id`", me.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	connections := []oidcConnection{}
+	for _, p := range oidcProviders {
+		c := oidcConnection{Provider: p}
+		for i := range identities {
+			if identities[i].Issuer == p.Issuer {
+				c.Identity = &identities[i]
+			}
+		}
+		connections = append(connections, c)
+	}
+
+	connectionsTemplate.Execute(w, struct {
+		Me          User
+		CSRFToken   string
+		Flash       string
+		Connections []oidcConnection
+	}{me, getCSRFToken(r), getFlash(w, r, "notice"), connections})
+}
+
+// ログインする手段がなくならないよう、パスワードも他の連携もなければ解除させない
+func postConnectionUnlink(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if !me.HasPassword() {
+		count := 0
+		err := db.Get(&count, "SELECT COUNT(*) FROM `user_identities` WHERE `user_id` = ?", me.ID)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		if count <= 1 {
+			redirectConnections(w, r, "連携を解除するには、先にパスワードを設定してください")
+			return
+		}
+	}
+
+	_, err := db.Exec("DELETE FROM `user_identities` WHERE `id` = ? AND `user_id` = ?", r.FormValue("id"), me.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	redirectConnections(w, r, "連携を解除しました")
+}
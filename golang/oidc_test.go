@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/catatsuy/private-isu/webapp/golang/mockoidc"
+)
+
+const (
+	testOIDCClientID     = "iscogram"
+	testOIDCClientSecret = "iscogram-secret"
+	testBaseURL          = "http://iscogram.test"
+)
+
+// ローカルのモックプロバイダを立て、それを使う設定にする
+func startMockOIDC(t *testing.T) *oidcProvider {
+	t.Helper()
+
+	var mock *mockoidc.Provider
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mock.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	var err error
+	mock, err = mockoidc.New(srv.URL, testOIDCClientID, testOIDCClientSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &oidcProvider{
+		Name:         "mock",
+		DisplayName:  "Mock",
+		Issuer:       srv.URL,
+		ClientID:     testOIDCClientID,
+		ClientSecret: testOIDCClientSecret,
+	}
+	orig := oidcProviders
+	oidcProviders = []*oidcProvider{p}
+	t.Cleanup(func() { oidcProviders = orig })
+	t.Setenv("ISUCONP_BASE_URL", testBaseURL)
+
+	useMemorySessionStore(t)
+	return p
+}
+
+// モックの認可画面でボタンを押し、リダイレクト先のURLを返す
+func authorizeAtMock(t *testing.T, authURL, action string) *url.URL {
+	t.Helper()
+
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	form := u.Query()
+	form.Set("sub", "mock-user-1")
+	form.Set("email", "mary@example.com")
+	form.Set("email_verified", "1")
+	form.Set("preferred_username", "mary.smith")
+	form.Set("action", action)
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.PostForm(u.Scheme+"://"+u.Host+u.Path, form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	loc, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize: status %d, location %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	return loc
+}
+
+// ログインの開始とコールバックだけを持つルーター
+// コールバックはDBを使う前の、IDトークンの確認までを行う
+func oidcTestRouter() http.Handler {
+	r := chi.NewRouter()
+	r.Get("/oidc/{provider}/login", getOIDCLogin)
+	r.Get("/oidc/{provider}/callback", func(w http.ResponseWriter, r *http.Request) {
+		claims, _, message := finishOIDCFlow(w, r, findOIDCProvider(chi.URLParam(r, "provider")))
+		if message != "" {
+			w.WriteHeader(http.StatusForbidden)
+			io.WriteString(w, message)
+			return
+		}
+		json.NewEncoder(w).Encode(claims)
+	})
+	return r
+}
+
+// ログインを始めて、プロバイダの認可画面のURLを返す
+func startOIDCLogin(t *testing.T, b *testBrowser, h http.Handler) string {
+	t.Helper()
+
+	w := b.do(h, httptest.NewRequest(http.MethodGet, "/oidc/mock/login", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("login: status %d", w.Code)
+	}
+	return w.Header().Get("Location")
+}
+
+func callback(b *testBrowser, h http.Handler, loc *url.URL) *httptest.ResponseRecorder {
+	return b.do(h, httptest.NewRequest(http.MethodGet, loc.RequestURI(), nil))
+}
+
+func TestOIDCLoginEndToEnd(t *testing.T) {
+	p := startMockOIDC(t)
+	h := oidcTestRouter()
+	b := newTestBrowser()
+
+	authURL := startOIDCLogin(t, b, h)
+	if !strings.HasPrefix(authURL, p.Issuer+"/authorize?") {
+		t.Fatalf("auth URL = %q", authURL)
+	}
+	q, _ := url.Parse(authURL)
+	if got := q.Query().Get("redirect_uri"); got != testBaseURL+"/oidc/mock/callback" {
+		t.Errorf("redirect_uri = %q", got)
+	}
+	if q.Query().Get("code_challenge_method") != "S256" || q.Query().Get("code_challenge") == "" {
+		t.Errorf("PKCE parameters are missing: %q", authURL)
+	}
+
+	loc := authorizeAtMock(t, authURL, "login")
+	w := callback(b, h, loc)
+	if w.Code != http.StatusOK {
+		t.Fatalf("callback: status %d: %s", w.Code, w.Body)
+	}
+	claims := oidcClaims{}
+	if err := json.NewDecoder(w.Body).Decode(&claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims.Issuer != p.Issuer || claims.Subject != "mock-user-1" || claims.verifiedEmail() != "mary@example.com" {
+		t.Errorf("claims = %+v", claims)
+	}
+	if got := suggestAccountName(claims); got != "marysmith" {
+		t.Errorf("suggestAccountName = %q", got)
+	}
+
+	// 同じstateとコードでもう一度戻ってきても受け付けない
+	if w := callback(b, h, loc); w.Code != http.StatusForbidden {
+		t.Fatalf("replayed callback: status %d", w.Code)
+	}
+}
+
+func TestOIDCCallbackRejectsWrongState(t *testing.T) {
+	startMockOIDC(t)
+	h := oidcTestRouter()
+	b := newTestBrowser()
+
+	loc := authorizeAtMock(t, startOIDCLogin(t, b, h), "login")
+	forged := *loc
+	q := forged.Query()
+	q.Set("state", "forged")
+	forged.RawQuery = q.Encode()
+	if w := callback(b, h, &forged); w.Code != http.StatusForbidden {
+		t.Fatalf("forged state: status %d", w.Code)
+	}
+
+	// 一度失敗したら、正しいstateでももう使えない
+	if w := callback(b, h, loc); w.Code != http.StatusForbidden {
+		t.Fatalf("state after failure: status %d", w.Code)
+	}
+}
+
+func TestOIDCCallbackRequiresSameSession(t *testing.T) {
+	startMockOIDC(t)
+	h := oidcTestRouter()
+
+	loc := authorizeAtMock(t, startOIDCLogin(t, newTestBrowser(), h), "login")
+	if w := callback(newTestBrowser(), h, loc); w.Code != http.StatusForbidden {
+		t.Fatalf("callback from another browser: status %d", w.Code)
+	}
+}
+
+func TestOIDCCallbackCancelled(t *testing.T) {
+	startMockOIDC(t)
+	h := oidcTestRouter()
+	b := newTestBrowser()
+
+	loc := authorizeAtMock(t, startOIDCLogin(t, b, h), "cancel")
+	if loc.Query().Get("error") != "access_denied" {
+		t.Fatalf("cancel redirect = %q", loc)
+	}
+	w := callback(b, h, loc)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "キャンセル") {
+		t.Fatalf("cancelled callback: status %d: %s", w.Code, w.Body)
+	}
+}
+
+// 認可コードを一つ発行してもらう
+func issueMockCode(t *testing.T, p *oidcProvider, flow oidcFlow) (*oidcConfig, string) {
+	t.Helper()
+
+	config, err := p.discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loc := authorizeAtMock(t, p.authURL(config, oidcRedirectURI(p), flow), "login")
+	if loc.Query().Get("state") != flow.State {
+		t.Fatalf("state = %q", loc.Query().Get("state"))
+	}
+	return config, loc.Query().Get("code")
+}
+
+func TestOIDCExchange(t *testing.T) {
+	p := startMockOIDC(t)
+	flow := oidcFlow{State: "state", Nonce: "nonce", CodeVerifier: secureRandomStr(32)}
+
+	t.Run("success and code reuse", func(t *testing.T) {
+		config, code := issueMockCode(t, p, flow)
+		if _, err := p.exchange(config, code, oidcRedirectURI(p), flow); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p.exchange(config, code, oidcRedirectURI(p), flow); err == nil {
+			t.Fatal("a code must not be exchanged twice")
+		}
+	})
+
+	t.Run("nonce mismatch", func(t *testing.T) {
+		config, code := issueMockCode(t, p, flow)
+		other := flow
+		other.Nonce = "other"
+		if _, err := p.exchange(config, code, oidcRedirectURI(p), other); err == nil {
+			t.Fatal("an id token with another nonce must be rejected")
+		}
+	})
+
+	t.Run("PKCE verifier mismatch", func(t *testing.T) {
+		config, code := issueMockCode(t, p, flow)
+		other := flow
+		other.CodeVerifier = secureRandomStr(32)
+		if _, err := p.exchange(config, code, oidcRedirectURI(p), other); err == nil {
+			t.Fatal("a code must not be exchanged with another verifier")
+		}
+	})
+
+	t.Run("client_secret_post", func(t *testing.T) {
+		config, code := issueMockCode(t, p, flow)
+		postOnly := *config
+		postOnly.TokenEndpointAuthMethods = []string{"client_secret_post"}
+		if _, err := p.exchange(&postOnly, code, oidcRedirectURI(p), flow); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// トークンエンドポイントから、検証前のIDトークンを受け取る
+func fetchMockIDToken(t *testing.T, p *oidcProvider, flow oidcFlow) (*oidcConfig, string) {
+	t.Helper()
+
+	config, code := issueMockCode(t, p, flow)
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {oidcRedirectURI(p)},
+		"code_verifier": {flow.CodeVerifier},
+		"client_id":     {p.ClientID},
+		"client_secret": {p.ClientSecret},
+	}
+	resp, err := http.PostForm(config.TokenEndpoint, form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	token := struct {
+		IDToken string `json:"id_token"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil || token.IDToken == "" {
+		t.Fatalf("token response: %v", err)
+	}
+	return config, token.IDToken
+}
+
+func TestOIDCVerifyIDToken(t *testing.T) {
+	p := startMockOIDC(t)
+	flow := oidcFlow{State: "state", Nonce: "nonce", CodeVerifier: secureRandomStr(32)}
+	config, idToken := fetchMockIDToken(t, p, flow)
+
+	if _, err := p.verifyIDToken(config, idToken, flow.Nonce, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.verifyIDToken(config, idToken, flow.Nonce, time.Now().Add(time.Hour)); err == nil {
+		t.Error("an expired id token must be rejected")
+	}
+
+	other := &oidcProvider{Issuer: p.Issuer, ClientID: "another-client"}
+	if _, err := other.verifyIDToken(config, idToken, flow.Nonce, time.Now()); err == nil {
+		t.Error("an id token for another client must be rejected")
+	}
+
+	// 署名はそのままで、subだけを書き換える
+	parts := strings.Split(idToken, ".")
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	payload = []byte(strings.Replace(string(payload), `"sub":"mock-user-1"`, `"sub":"admin"`, 1))
+	tampered := parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2]
+	if _, err := p.verifyIDToken(config, tampered, flow.Nonce, time.Now()); err == nil {
+		t.Error("a tampered id token must be rejected")
+	}
+}
+
+func TestOIDCAudience(t *testing.T) {
+	for _, tc := range []struct {
+		json string
+		want bool
+	}{
+		{`"iscogram"`, true},
+		{`["other","iscogram"]`, true},
+		{`"other"`, false},
+	} {
+		var aud oidcAudience
+		if err := json.Unmarshal([]byte(tc.json), &aud); err != nil {
+			t.Fatal(err)
+		}
+		if aud.contains("iscogram") != tc.want {
+			t.Errorf("%s contains iscogram = %v", tc.json, !tc.want)
+		}
+	}
+}
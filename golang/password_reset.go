@@ -0,0 +1,313 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"html/template"
+	"log"
+	"net/http"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const passwordResetTTL = time.Hour
+
+// パスワードを変えて、それまでのセッションを無効にする
+// 呼び出し元のセッションを続けたいときは、この後でstartLoginSessionし直す
+func changePassword(userID int, password string) error {
+	passhash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE `users` SET `passhash` = ? WHERE `id` = ?", passhash, userID)
+	if err != nil {
+		return err
+	}
+	return revokeAllSessions(userID)
+}
+
+var (
+	passwordSettingsTemplate = template.Must(template.ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("password.html")),
+	)
+)
+
+func getPasswordSettings(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	passwordSettingsTemplate.Execute(w, struct {
+		Me        User
+		CSRFToken string
+		Flash     string
+	}{me, getCSRFToken(r), getFlash(w, r, "notice")})
+}
+
+func redirectPasswordSettings(w http.ResponseWriter, r *http.Request, notice string) {
+	session := getSession(r)
+	session.Values["notice"] = notice
+	session.Save(r, w)
+
+	http.Redirect(w, r, "/settings/password", http.StatusFound)
+}
+
+func postPasswordSettings(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	// 外部のアカウントで登録したユーザーは、現在のパスワードなしで最初のパスワードを設定できる
+	if ok, _ := verifyPassword(me, r.FormValue("current_password")); me.HasPassword() && !ok {
+		redirectPasswordSettings(w, r, "現在のパスワードが間違っています")
+		return
+	}
+
+	password := r.FormValue("new_password")
+	if !validateUser(me.AccountName, password) {
+		redirectPasswordSettings(w, r, "パスワードは6文字以上である必要があります")
+		return
+	}
+
+	err := changePassword(me.ID, password)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	// 他の端末のセッションは無効になり、このセッションだけ続けられる
+	startLoginSession(w, r, me.ID)
+
+	redirectPasswordSettings(w, r, "パスワードを変更しました")
+}
+
+func postEmailSettings(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	// 空なら登録を消す。名前付きの形式は通知のヘッダを組み立てにくいので受け付けない
+	var email interface{}
+	if v := r.FormValue("email"); v != "" {
+		addr, err := mail.ParseAddress(v)
+		if err != nil || addr.Address != v {
+			redirectPasswordSettings(w, r, "メールアドレスの形式が正しくありません")
+			return
+		}
+		email = v
+	}
+
+	_, err := db.Exec("UPDATE `users` SET `email` = ? WHERE `id` = ?", email, me.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	invalidateUserCache(me.ID)
+
+	redirectPasswordSettings(w, r, "連絡先を変更しました")
+}
+
+func passwordResetTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// 外から見たこのサイトのURL。ISUCONP_BASE_URLで設定する
+// Hostヘッダはクライアントが自由に送れるので、メールに載せるリンクをそこから組み立ててはいけない
+func configuredBaseURL() (string, bool) {
+	base := os.Getenv("ISUCONP_BASE_URL")
+	if base == "" {
+		return "", false
+	}
+	return strings.TrimSuffix(base, "/"), true
+}
+
+// 再設定用のリンクのURL。ISUCONP_BASE_URLがなければ作れない
+func passwordResetURL(token string) (string, bool) {
+	base, ok := configuredBaseURL()
+	if !ok {
+		return "", false
+	}
+	return base + "/password/reset/" + token, true
+}
+
+var (
+	passwordResetTemplate = template.Must(template.ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("password_reset.html")),
+	)
+	passwordResetTokenTemplate = template.Must(template.ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("password_reset_token.html")),
+	)
+)
+
+func getPasswordReset(w http.ResponseWriter, r *http.Request) {
+	if isLogin(getSessionUser(r)) {
+		http.Redirect(w, r, "/settings/password", http.StatusFound)
+		return
+	}
+
+	csrfToken := issueCSRFToken(w, r)
+	passwordResetTemplate.Execute(w, struct {
+		Me        User
+		Flash     string
+		CSRFToken string
+	}{User{}, getFlash(w, r, "notice"), csrfToken})
+}
+
+func postPasswordReset(w http.ResponseWriter, r *http.Request) {
+	if isLogin(getSessionUser(r)) {
+		http.Redirect(w, r, "/settings/password", http.StatusFound)
+		return
+	}
+
+	// 登録されているアカウントかどうかが分からないよう、結果によらず同じ案内を出す
+	session := getSession(r)
+	session.Values["notice"] = "登録されている連絡先に、パスワードを再設定するためのリンクを送りました"
+	session.Save(r, w)
+
+	u := User{}
+	err := db.Get(&u, "SELECT * FROM `users` WHERE `account_name` = ? AND `del_flg` = 0", r.FormValue("account_name"))
+	if err != nil {
+		http.Redirect(w, r, "/password/reset", http.StatusFound)
+		return
+	}
+
+	token := secureRandomStr(32)
+	resetURL, ok := passwordResetURL(token)
+	if !ok {
+		log.Print("ISUCONP_BASE_URL is not set; password reset link was not sent")
+		http.Redirect(w, r, "/password/reset", http.StatusFound)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	defer tx.Rollback()
+
+	// 使えるリンクは最後に発行したものだけにする
+	_, err = tx.Exec("UPDATE `password_resets` SET `used_at` = NOW() WHERE `user_id` = ? AND `used_at` IS NULL", u.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	_, err = tx.Exec("INSERT INTO `password_resets` (`user_id`, `token_hash`, `expires_at`) VALUES (?,?,?)",
+		u.ID, passwordResetTokenHash(token), time.Now().Add(passwordResetTTL))
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Print(err)
+		return
+	}
+
+	body := "以下のリンクから、1時間以内にパスワードを再設定してください。\n" +
+		"心当たりがない場合は、このメッセージを無視してください。\n\n" +
+		resetURL
+	err = notifier.Notify(u, "Iscogram パスワードの再設定", body)
+	if err != nil {
+		log.Print(err)
+	}
+
+	http.Redirect(w, r, "/password/reset", http.StatusFound)
+}
+
+// 有効なトークンなら、そのユーザーのIDを返す
+func findPasswordReset(token string) (int, bool) {
+	userID := 0
+	err := db.Get(&userID, "SELECT `user_id` FROM `password_resets` WHERE `token_hash` = ? AND `used_at` IS NULL AND `expires_at` > ?",
+		passwordResetTokenHash(token), time.Now())
+	if err != nil {
+		return 0, false
+	}
+	return userID, true
+}
+
+func getPasswordResetToken(w http.ResponseWriter, r *http.Request) {
+	token := chi.URLParam(r, "token")
+	if _, ok := findPasswordReset(token); !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	csrfToken := issueCSRFToken(w, r)
+	passwordResetTokenTemplate.Execute(w, struct {
+		Token     string
+		Me        User
+		Flash     string
+		CSRFToken string
+	}{token, getSessionUser(r), getFlash(w, r, "notice"), csrfToken})
+}
+
+func postPasswordResetToken(w http.ResponseWriter, r *http.Request) {
+	token := chi.URLParam(r, "token")
+	userID, ok := findPasswordReset(token)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	u := User{}
+	err := db.Get(&u, "SELECT * FROM `users` WHERE `id` = ? AND `del_flg` = 0", userID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	password := r.FormValue("password")
+	if !validateUser(u.AccountName, password) {
+		session := getSession(r)
+		session.Values["notice"] = "パスワードは6文字以上である必要があります"
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/password/reset/"+token, http.StatusFound)
+		return
+	}
+
+	// 同じリンクで二度再設定できないよう、使用済みにできたときだけ変更する
+	result, err := db.Exec("UPDATE `password_resets` SET `used_at` = NOW() WHERE `token_hash` = ? AND `used_at` IS NULL",
+		passwordResetTokenHash(token))
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	if n == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	err = changePassword(u.ID, password)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	if err := clearLoginFailures(accountLoginThrottle, u.AccountName); err != nil {
+		log.Print(err)
+	}
+
+	session := getSession(r)
+	session.Values["notice"] = "パスワードを再設定しました。新しいパスワードでログインしてください"
+	session.Save(r, w)
+
+	http.Redirect(w, r, "/login", http.StatusFound)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	passwordAlgorithmArgon2id = "argon2id"
+	passwordAlgorithmBcrypt   = "bcrypt"
+)
+
+// 新しく保存するハッシュの方式とコスト
+// 既存のハッシュと違っていれば、次のログイン時に作り直す
+type passwordHashConfig struct {
+	Algorithm string
+	// argon2idのパラメータ。MemoryはKiB単位
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+	// bcryptのコスト
+	Cost int
+}
+
+const (
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+// argon2idの既定値はOWASPの推奨する最小構成
+var passwordHash = passwordHashConfig{
+	Algorithm: passwordAlgorithmArgon2id,
+	Memory:    19 * 1024,
+	Time:      2,
+	Threads:   1,
+	Cost:      bcrypt.DefaultCost,
+}
+
+// 環境変数で方式とコストを変えられるようにする。不正な値なら起動しない
+func loadPasswordHashConfig() {
+	if v := os.Getenv("ISUCONP_PASSWORD_HASH"); v != "" {
+		if v != passwordAlgorithmArgon2id && v != passwordAlgorithmBcrypt {
+			log.Fatalf("ISUCONP_PASSWORD_HASH must be %s or %s: %s", passwordAlgorithmArgon2id, passwordAlgorithmBcrypt, v)
+		}
+		passwordHash.Algorithm = v
+	}
+
+	uintEnv := func(key string, bits int, dest func(uint64)) {
+		v := os.Getenv(key)
+		if v == "" {
+			return
+		}
+		n, err := strconv.ParseUint(v, 10, bits)
+		if err != nil || n == 0 {
+			log.Fatalf("%s must be a positive integer: %s", key, v)
+		}
+		dest(n)
+	}
+	uintEnv("ISUCONP_ARGON2_MEMORY", 32, func(n uint64) { passwordHash.Memory = uint32(n) })
+	uintEnv("ISUCONP_ARGON2_TIME", 32, func(n uint64) { passwordHash.Time = uint32(n) })
+	uintEnv("ISUCONP_ARGON2_THREADS", 8, func(n uint64) { passwordHash.Threads = uint8(n) })
+	uintEnv("ISUCONP_BCRYPT_COST", 8, func(n uint64) { passwordHash.Cost = int(n) })
+	if passwordHash.Cost < bcrypt.MinCost || passwordHash.Cost > bcrypt.MaxCost {
+		log.Fatalf("ISUCONP_BCRYPT_COST must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+}
+
+// 方式とパラメータを含む自己記述的な形式で返す
+// argon2idはPHC文字列形式、bcryptはbcrypt自体の形式
+func hashPassword(password string) (string, error) {
+	if passwordHash.Algorithm == passwordAlgorithmBcrypt {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordHash.Cost)
+		if err != nil {
+			return "", err
+		}
+		return string(hash), nil
+	}
+
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, passwordHash.Time, passwordHash.Memory, passwordHash.Threads, argon2KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, passwordHash.Memory, passwordHash.Time, passwordHash.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// パスワードが合っているかと、今の設定でハッシュを作り直すべきかを返す
+// 初期データのようなSHA-512の古いハッシュも確認できる
+func verifyPassword(u User, password string) (ok bool, needsRehash bool) {
+	switch {
+	case !u.HasPassword():
+		return false, false
+	case strings.HasPrefix(u.Passhash, "$argon2id$"):
+		var version int
+		var memory, time uint32
+		var threads uint8
+		parts := strings.Split(u.Passhash, "$")
+		if len(parts) != 6 {
+			return false, false
+		}
+		if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+			return false, false
+		}
+		if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+			return false, false
+		}
+		salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+		if err != nil {
+			return false, false
+		}
+		want, err := base64.RawStdEncoding.DecodeString(parts[5])
+		if err != nil {
+			return false, false
+		}
+
+		got := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(want)))
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			return false, false
+		}
+		return true, passwordHash.Algorithm != passwordAlgorithmArgon2id ||
+			memory != passwordHash.Memory || time != passwordHash.Time || threads != passwordHash.Threads
+	case strings.HasPrefix(u.Passhash, "$2"):
+		if bcrypt.CompareHashAndPassword([]byte(u.Passhash), []byte(password)) != nil {
+			return false, false
+		}
+		cost, err := bcrypt.Cost([]byte(u.Passhash))
+		return true, err != nil || passwordHash.Algorithm != passwordAlgorithmBcrypt || cost != passwordHash.Cost
+	default:
+		want := calculatePasshash(u.AccountName, password)
+		return subtle.ConstantTimeCompare([]byte(want), []byte(u.Passhash)) == 1, true
+	}
+}
+
+// 外部のアカウントで登録したユーザーは、パスワードを設定するまでパスワードを持たない
+func (u User) HasPassword() bool {
+	return u.Passhash != ""
+}
+
+// ログインに成功したときに、古い方式やコストのハッシュを今の設定で作り直す
+// 同時にログインした別のリクエストと競合しても、どちらかのハッシュが残るだけなので問題ない
+func rehashPassword(u User, password string) {
+	hash, err := hashPassword(password)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	_, err = db.Exec("UPDATE `users` SET `passhash` = ? WHERE `id` = ? AND `passhash` = ?", hash, u.ID, u.Passhash)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	invalidateUserCache(u.ID)
+}
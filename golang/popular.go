@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	popularCacheKey = "popular:ranking"
+	popularInterval = time.Minute
+	popularLimit    = 100
+	// この期間内に投稿されたものだけを対象にする
+	popularWindow = 7 * 24 * time.Hour
+	// コメントの重みが半分になるまでの時間
+	popularHalfLife = 6 * time.Hour
+)
+
+type popularEntry struct {
+	ID    int     `db:"id" json:"id"`
+	Score float64 `db:"score" json:"score"`
+}
+
+// 最近の投稿を、コメントが付いた時刻ごとに減衰させた重みの合計で並べる
+// 閲覧者によって結果が変わらないように、全体公開の投稿だけを対象にする
+func computePopularRanking() ([]popularEntry, error) {
+	now := time.Now()
+	ranking := []popularEntry{}
+	err := db.Select(&ranking,
+		"SELECT c.post_id AS id, SUM(POW(0.5, TIMESTAMPDIFF(SECOND, c.created_at, ?) / ?)) AS score "+
+			"FROM `comments` AS c JOIN `posts` AS p ON (c.post_id=p.id) "+
+			"WHERE p.created_at >= ? AND p.status = ? AND p.visibility = ? "+
+			"GROUP BY c.post_id ORDER BY score DESC LIMIT ?",
+		now, popularHalfLife.Seconds(), now.Add(-popularWindow), postStatusPublished, visibilityPublic, popularLimit)
+	if err != nil {
+		return nil, err
+	}
+	return ranking, nil
+}
+
+// このプロセスが最後に計算したランキング。memcacheから消えていても、計算し直さずにこれを出す
+var lastPopularRanking struct {
+	mu       sync.Mutex
+	ranking  []popularEntry
+	computed bool
+}
+
+// 計算し直してlastPopularRankingとmemcacheに置く。lastPopularRanking.muを取ってから呼ぶ
+func storePopularRanking() error {
+	ranking, err := computePopularRanking()
+	if err != nil {
+		return err
+	}
+	lastPopularRanking.ranking = ranking
+	lastPopularRanking.computed = true
+
+	value, err := json.Marshal(ranking)
+	if err != nil {
+		return err
+	}
+	return memcacheClient.Set(&memcache.Item{
+		Key:        popularCacheKey,
+		Value:      value,
+		Expiration: int32(popularInterval.Seconds() * 2),
+	})
+}
+
+// 定期的にランキングを計算し直してmemcacheに置く
+// 複数のプロセスで動いていても同じ結果で上書きするだけなので問題ない
+func refreshPopularRanking() error {
+	lastPopularRanking.mu.Lock()
+	defer lastPopularRanking.mu.Unlock()
+
+	return storePopularRanking()
+}
+
+// memcacheにないときは最後に計算したランキングを出し、まだ一度も計算していなければここで計算して置く
+// 同時に来ても計算するのは一つだけで、残りはその結果を使う
+func lastOrComputePopularRanking() ([]popularEntry, error) {
+	lastPopularRanking.mu.Lock()
+	defer lastPopularRanking.mu.Unlock()
+
+	if !lastPopularRanking.computed {
+		err := storePopularRanking()
+		if !lastPopularRanking.computed {
+			return nil, err
+		}
+		if err != nil {
+			log.Print(err)
+		}
+	}
+	return lastPopularRanking.ranking, nil
+}
+
+func getPopularRanking() ([]popularEntry, error) {
+	item, err := memcacheClient.Get(popularCacheKey)
+	if err == memcache.ErrCacheMiss {
+		return lastOrComputePopularRanking()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ranking := []popularEntry{}
+	err = json.Unmarshal(item.Value, &ranking)
+	if err != nil {
+		return nil, err
+	}
+	return ranking, nil
+}
+
+// ランキング順に、meが見られる投稿を並べて返す
+func selectPopularPosts(me User, csrfToken string) ([]Post, error) {
+	ranking, err := getPopularRanking()
+	if err != nil {
+		return nil, err
+	}
+	if len(ranking) == 0 {
+		return []Post{}, nil
+	}
+
+	ids := make([]int, 0, len(ranking))
+	for _, e := range ranking {
+		ids = append(ids, e.ID)
+	}
+
+	// ランキングを計算してから後にBANやミュートされた投稿はここで落とす
+	args := append([]interface{}{ids}, visiblePostsArgs(me)...)
+	q, args, err := sqlx.In(
+		"SELECT p.id, p.user_id, p.body, p.mime, p.visibility, p.status, p.publish_at, p.created_at, "+
+			"u.account_name as `user.account_name`"+
+			" FROM `posts` AS p JOIN `users` AS u ON (p.user_id=u.id) "+
+			"WHERE p.id IN (?) AND u.del_flg=0 AND "+publishedPostsCondition+" AND "+visiblePostsCondition+" AND "+unmutedPostsCondition,
+		append(args, me.ID)...)
+	if err != nil {
+		return nil, err
+	}
+	rows := []Post{}
+	err = db.Select(&rows, q, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	byID := make(map[int]Post, len(rows))
+	for _, p := range rows {
+		byID[p.ID] = p
+	}
+	results := make([]Post, 0, len(rows))
+	for _, id := range ids {
+		if p, ok := byID[id]; ok {
+			results = append(results, p)
+		}
+	}
+	if len(results) > postsPerPage {
+		results = results[:postsPerPage]
+	}
+
+	return makePosts(results, me, csrfToken, indexCommentsPerPost)
+}
+
+var (
+	popularTemplate = template.Must(template.New("layout.html").Funcs(template.FuncMap{
+		"imageURL":     imageURL,
+		"postImageURL": postImageURL,
+	}).ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("popular.html"),
+		getTemplPath("posts.html"),
+		getTemplPath("post.html"),
+		getTemplPath("comment.html"),
+		getTemplPath("reply.html"),
+	))
+)
+
+func getPopular(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+
+	posts, err := selectPopularPosts(me, getCSRFToken(r))
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	popularTemplate.Execute(w, struct {
+		Posts []Post
+		Me    User
+	}{posts, me})
+}
+
+type popularPostJSON struct {
+	ID           int       `json:"id"`
+	AccountName  string    `json:"account_name"`
+	Body         string    `json:"body"`
+	ImageURLs    []string  `json:"image_urls"`
+	CommentCount int       `json:"comment_count"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+func getPopularJSON(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+
+	posts, err := selectPopularPosts(me, "")
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	res := make([]popularPostJSON, 0, len(posts))
+	for _, p := range posts {
+		urls := make([]string, 0, len(p.Images))
+		for _, img := range p.Images {
+			urls = append(urls, postImageURL(img))
+		}
+		res = append(res, popularPostJSON{
+			ID:           p.ID,
+			AccountName:  p.User.AccountName,
+			Body:         p.Body,
+			ImageURLs:    urls,
+			CommentCount: p.CommentCount,
+			CreatedAt:    p.CreatedAt,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// memcacheから消えても、集計をやり直さずに最後のランキングを出す
+// dbはテストでは使えないので、計算し直そうとすればpanicになる
+func TestGetPopularRankingServesLastRanking(t *testing.T) {
+	useMemcachedStandIn(t)
+	t.Cleanup(func() {
+		lastPopularRanking.ranking = nil
+		lastPopularRanking.computed = false
+	})
+
+	want := []popularEntry{{ID: 2, Score: 1.5}, {ID: 1, Score: 0.5}}
+	lastPopularRanking.ranking = want
+	lastPopularRanking.computed = true
+
+	ranking, err := getPopularRanking()
+	if err != nil || !reflect.DeepEqual(ranking, want) {
+		t.Fatalf("ranking = %v, err = %v", ranking, err)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"log"
+	"net/http"
+)
+
+// フォロー・ブロック・ミュートはいずれも「ログインユーザーから相手への関係」なので、
+// 付け外しのハンドラは同じ形になる。queriesにはme.IDと相手のIDを順に渡す
+func relationHandler(queries ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		me := getSessionUser(r)
+		if !isLogin(me) {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+
+		user := User{}
+		err := db.Get(&user, "SELECT * FROM `users` WHERE `id` = ?", r.FormValue("user_id"))
+		if err != nil || user.ID == me.ID {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		for _, query := range queries {
+			_, err = db.Exec(query, me.ID, user.ID)
+			if err != nil {
+				log.Print(err)
+				return
+			}
+		}
+
+		http.Redirect(w, r, "/@"+user.AccountName, http.StatusFound)
+	}
+}
+
+var (
+	// ブロックされている相手はフォローできない
+	postFollow = relationHandler(
+		"INSERT IGNORE INTO `follows` (`follower_id`, `followee_id`) " +
+			"SELECT r.follower_id, r.followee_id FROM (SELECT ? AS follower_id, ? AS followee_id) AS r " +
+			"WHERE NOT EXISTS (SELECT 1 FROM `blocks` AS b WHERE b.blocker_id = r.followee_id AND b.blocked_id = r.follower_id)",
+	)
+	postUnfollow = relationHandler(
+		"DELETE FROM `follows` WHERE `follower_id` = ? AND `followee_id` = ?",
+	)
+	// ブロックした相手からのフォローは外して、フォロワー限定の投稿も見えなくする
+	postBlock = relationHandler(
+		"INSERT IGNORE INTO `blocks` (`blocker_id`, `blocked_id`) VALUES (?,?)",
+		"DELETE FROM `follows` WHERE `followee_id` = ? AND `follower_id` = ?",
+	)
+	postUnblock = relationHandler(
+		"DELETE FROM `blocks` WHERE `blocker_id` = ? AND `blocked_id` = ?",
+	)
+	postMute = relationHandler(
+		"INSERT IGNORE INTO `mutes` (`muter_id`, `muted_id`) VALUES (?,?)",
+	)
+	postUnmute = relationHandler(
+		"DELETE FROM `mutes` WHERE `muter_id` = ? AND `muted_id` = ?",
+	)
+)
+
+func isFollowing(followerID, followeeID int) bool {
+	exists := 0
+	// フォローしていない場合はエラーになるのでエラーチェックはしない
+	db.Get(&exists, "SELECT 1 FROM `follows` WHERE `follower_id` = ? AND `followee_id` = ?", followerID, followeeID)
+	return exists == 1
+}
+
+func isBlocking(blockerID, blockedID int) bool {
+	exists := 0
+	// ブロックしていない場合はエラーになるのでエラーチェックはしない
+	db.Get(&exists, "SELECT 1 FROM `blocks` WHERE `blocker_id` = ? AND `blocked_id` = ?", blockerID, blockedID)
+	return exists == 1
+}
+
+func isMuting(muterID, mutedID int) bool {
+	exists := 0
+	// ミュートしていない場合はエラーになるのでエラーチェックはしない
+	db.Get(&exists, "SELECT 1 FROM `mutes` WHERE `muter_id` = ? AND `muted_id` = ?", muterID, mutedID)
+	return exists == 1
+}
+
+// postsをpという別名で参照するクエリに付け足して、meがミュートしている相手の投稿を除く
+const unmutedPostsCondition = "NOT EXISTS (SELECT 1 FROM `mutes` AS m WHERE m.muter_id = ? AND m.muted_id = p.user_id)"
+
+func mutedUserIDs(me User) map[int]bool {
+	muted := map[int]bool{}
+	if !isLogin(me) {
+		return muted
+	}
+
+	ids := []int{}
+	err := db.Select(&ids, "SELECT `muted_id` FROM `mutes` WHERE `muter_id` = ?", me.ID)
+	if err != nil {
+		log.Print(err)
+		return muted
+	}
+	for _, id := range ids {
+		muted[id] = true
+	}
+	return muted
+}
+
+// コメントのキャッシュは閲覧者によらず共通なので、ミュートは取り出したあとに適用する
+func filterMutedComments(comments []Comment, muted map[int]bool) []Comment {
+	if len(muted) == 0 {
+		return comments
+	}
+
+	filtered := make([]Comment, 0, len(comments))
+	for _, c := range comments {
+		if muted[c.UserID] {
+			continue
+		}
+		replies := make([]Comment, 0, len(c.Replies))
+		for _, reply := range c.Replies {
+			if !muted[reply.UserID] {
+				replies = append(replies, reply)
+			}
+		}
+		c.Replies = replies
+		filtered = append(filtered, c)
+	}
+	return filtered
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"log"
+	"net/http"
+)
+
+const (
+	roleUser      = "user"
+	roleModerator = "moderator"
+	roleAdmin     = "admin"
+)
+
+const (
+	permBan           = "ban"
+	permDeleteContent = "delete-content"
+	permViewReports   = "view-reports"
+	permManageRoles   = "manage-roles"
+	permViewDashboard = "view-dashboard"
+)
+
+// ロールごとに許可する操作。ここにないロールは何もできない
+var rolePermissions = map[string]map[string]bool{
+	roleUser: {},
+	roleModerator: {
+		permBan:           true,
+		permDeleteContent: true,
+		permViewReports:   true,
+	},
+	roleAdmin: {
+		permBan:           true,
+		permDeleteContent: true,
+		permViewReports:   true,
+		permManageRoles:   true,
+		permViewDashboard: true,
+	},
+}
+
+// 画面での並び順
+var roles = []string{roleUser, roleModerator, roleAdmin}
+
+func (u User) Can(perm string) bool {
+	return rolePermissions[u.Role][perm]
+}
+
+// 管理画面のように何かしらの権限を持つユーザーか
+func (u User) IsStaff() bool {
+	return len(rolePermissions[u.Role]) > 0
+}
+
+type sessionUserKey struct{}
+
+// permを持たないユーザーのリクエストを弾くミドルウェア
+// 確認に使ったユーザーはcontextに入れておき、ハンドラでのgetSessionUserで使い回す
+func requirePermission(perm string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			me := getSessionUser(r)
+			if !isLogin(me) {
+				http.Redirect(w, r, "/", http.StatusFound)
+				return
+			}
+
+			if !me.Can(perm) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+
+			if require2FAForStaff && !me.HasTOTP() {
+				session := getSession(r)
+				session.Values["notice"] = "管理画面を使うには2段階認証を設定してください"
+				session.Save(r, w)
+
+				http.Redirect(w, r, "/settings/2fa", http.StatusFound)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), sessionUserKey{}, me)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+var (
+	adminRolesTemplate = template.Must(template.ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("roles.html")),
+	)
+)
+
+func getAdminRoles(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+
+	users := []User{}
+	err := db.Select(&users, "SELECT * FROM `users` WHERE `role` != ? AND `del_flg` = 0 ORDER BY `role`, `account_name`", roleUser)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	adminRolesTemplate.Execute(w, struct {
+		Users     []User
+		Roles     []string
+		Me        User
+		CSRFToken string
+		Flash     string
+	}{users, roles, me, getCSRFToken(r), getFlash(w, r, "notice")})
+}
+
+func postAdminRoles(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+
+	role := r.FormValue("role")
+	if _, ok := rolePermissions[role]; !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	user := User{}
+	err := db.Get(&user, "SELECT * FROM `users` WHERE `account_name` = ? AND `del_flg` = 0", r.FormValue("account_name"))
+	if err != nil {
+		session := getSession(r)
+		session.Values["notice"] = "ユーザーが見つかりません"
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/admin/roles", http.StatusFound)
+		return
+	}
+
+	// 管理者がいなくならないよう、自分のロールは変えられない
+	if user.ID == me.ID {
+		session := getSession(r)
+		session.Values["notice"] = "自分のロールは変更できません"
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/admin/roles", http.StatusFound)
+		return
+	}
+
+	// authorityは初期データとの互換のために残しているので、adminかどうかに合わせておく
+	authority := 0
+	if role == roleAdmin {
+		authority = 1
+	}
+	_, err = db.Exec("UPDATE `users` SET `role` = ?, `authority` = ? WHERE `id` = ?", role, authority, user.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	invalidateUserCache(user.ID)
+	recordModerationAction(me.ID, "role:"+role, reportTargetUser, user.ID, 0)
+
+	http.Redirect(w, r, "/admin/roles", http.StatusFound)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// バックグラウンドでintervalごとにfnを実行する
+// 失敗してもログに残して次の回に再試行する
+func startPeriodicJob(name string, interval time.Duration, fn func() error) {
+	run := func() {
+		defer func() {
+			if err := recover(); err != nil {
+				log.Printf("%s: panic: %v", name, err)
+			}
+		}()
+		if err := fn(); err != nil {
+			log.Printf("%s: %s", name, err)
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			run()
+			<-ticker.C
+		}
+	}()
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"log"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// 起動時に順番に適用するスキーマ変更
+// 何番目まで適用したかをschema_migrationsに記録し、適用済みのものは流さない
+// 番号は並び順で決まるので、追加は必ず末尾に行い、途中を消したり並べ替えたりしない
+// バージョンを記録する前から動いているDBでは一度すべてが流れるので、何度流しても結果が変わらないように書く
+var schemaMigrations = []string{
+	"ALTER TABLE `comments` ADD COLUMN `parent_id` INT NOT NULL DEFAULT 0",
+	"ALTER TABLE `comments` ADD INDEX `idx_parent_id` (`parent_id`, `created_at`)",
+	"CREATE TABLE IF NOT EXISTS `notifications` (" +
+		"`id` INT NOT NULL AUTO_INCREMENT PRIMARY KEY," +
+		"`user_id` INT NOT NULL," +
+		"`actor_id` INT NOT NULL," +
+		"`post_id` INT NOT NULL," +
+		"`comment_id` INT NOT NULL," +
+		"`created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"INDEX `idx_user_id` (`user_id`, `created_at`)" +
+		") DEFAULT CHARSET=utf8mb4",
+	"ALTER TABLE `posts` ADD COLUMN `visibility` TINYINT NOT NULL DEFAULT 0",
+	"CREATE TABLE IF NOT EXISTS `follows` (" +
+		"`follower_id` INT NOT NULL," +
+		"`followee_id` INT NOT NULL," +
+		"`created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"PRIMARY KEY (`follower_id`, `followee_id`)," +
+		"INDEX `idx_followee_id` (`followee_id`)" +
+		") DEFAULT CHARSET=utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `blocks` (" +
+		"`blocker_id` INT NOT NULL," +
+		"`blocked_id` INT NOT NULL," +
+		"`created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"PRIMARY KEY (`blocker_id`, `blocked_id`)" +
+		") DEFAULT CHARSET=utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `mutes` (" +
+		"`muter_id` INT NOT NULL," +
+		"`muted_id` INT NOT NULL," +
+		"`created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"PRIMARY KEY (`muter_id`, `muted_id`)" +
+		") DEFAULT CHARSET=utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `collections` (" +
+		"`id` INT NOT NULL AUTO_INCREMENT PRIMARY KEY," +
+		"`user_id` INT NOT NULL," +
+		"`slug` VARCHAR(64) NOT NULL," +
+		"`name` VARCHAR(255) NOT NULL," +
+		"`is_public` TINYINT(1) NOT NULL DEFAULT 0," +
+		"`created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"UNIQUE KEY `uniq_user_id_slug` (`user_id`, `slug`)" +
+		") DEFAULT CHARSET=utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `collection_posts` (" +
+		"`collection_id` INT NOT NULL," +
+		"`post_id` INT NOT NULL," +
+		"`position` INT NOT NULL," +
+		"`created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"PRIMARY KEY (`collection_id`, `post_id`)," +
+		"INDEX `idx_collection_id_position` (`collection_id`, `position`)" +
+		") DEFAULT CHARSET=utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `post_images` (" +
+		"`id` INT NOT NULL AUTO_INCREMENT PRIMARY KEY," +
+		"`post_id` INT NOT NULL," +
+		"`position` INT NOT NULL," +
+		"`mime` VARCHAR(64) NOT NULL," +
+		"`created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"UNIQUE KEY `uniq_post_id_position` (`post_id`, `position`)" +
+		") DEFAULT CHARSET=utf8mb4",
+	// 画像1枚だけの投稿を1枚目の画像として移行する。ファイル名とURLは変わらない
+	// 一度だけ流れる。それ以降の投稿は投稿時にpost_imagesへ入る
+	"INSERT IGNORE INTO `post_images` (`post_id`, `position`, `mime`) SELECT `id`, 0, `mime` FROM `posts`",
+	"ALTER TABLE `posts` ADD COLUMN `status` TINYINT NOT NULL DEFAULT 0",
+	"ALTER TABLE `posts` ADD COLUMN `publish_at` DATETIME NULL",
+	"ALTER TABLE `posts` ADD INDEX `idx_status_publish_at` (`status`, `publish_at`)",
+	"CREATE TABLE IF NOT EXISTS `reports` (" +
+		"`id` INT NOT NULL AUTO_INCREMENT PRIMARY KEY," +
+		"`reporter_id` INT NOT NULL," +
+		"`target_type` VARCHAR(16) NOT NULL," +
+		"`target_id` INT NOT NULL," +
+		"`target_user_id` INT NOT NULL," +
+		"`reason` TEXT NOT NULL," +
+		"`status` TINYINT NOT NULL DEFAULT 0," +
+		"`resolved_by` INT NULL," +
+		"`resolved_at` DATETIME NULL," +
+		"`created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"INDEX `idx_status_created_at` (`status`, `created_at`)," +
+		"INDEX `idx_target` (`target_type`, `target_id`)" +
+		") DEFAULT CHARSET=utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `moderation_actions` (" +
+		"`id` INT NOT NULL AUTO_INCREMENT PRIMARY KEY," +
+		"`admin_id` INT NOT NULL," +
+		"`action` VARCHAR(32) NOT NULL," +
+		"`target_type` VARCHAR(16) NOT NULL," +
+		"`target_id` INT NOT NULL," +
+		"`report_id` INT NOT NULL DEFAULT 0," +
+		"`created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"INDEX `idx_created_at` (`created_at`)" +
+		") DEFAULT CHARSET=utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `bans` (" +
+		"`id` INT NOT NULL AUTO_INCREMENT PRIMARY KEY," +
+		"`user_id` INT NOT NULL," +
+		"`admin_id` INT NOT NULL," +
+		"`reason` TEXT NOT NULL," +
+		"`expires_at` DATETIME NULL," +
+		"`lifted_at` DATETIME NULL," +
+		"`lifted_by` INT NULL," +
+		"`created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"INDEX `idx_user_id` (`user_id`, `lifted_at`)," +
+		"INDEX `idx_expires_at` (`lifted_at`, `expires_at`)" +
+		") DEFAULT CHARSET=utf8mb4",
+	"ALTER TABLE `users` ADD COLUMN `sessions_revoked_at` DATETIME(6) NULL",
+	"ALTER TABLE `users` ADD COLUMN `role` VARCHAR(16) NOT NULL DEFAULT 'user'",
+	// ロールを変えるときはauthorityも合わせて更新するので、何度流しても結果は変わらない
+	"UPDATE `users` SET `role` = 'admin' WHERE `authority` = 1 AND `role` = 'user'",
+	// argon2idのPHC文字列はパラメータによって128文字を超えうる
+	"ALTER TABLE `users` MODIFY `passhash` VARCHAR(255) NOT NULL",
+	"ALTER TABLE `users` ADD COLUMN `totp_secret` VARCHAR(64) NULL",
+	"ALTER TABLE `users` ADD COLUMN `totp_last_step` BIGINT NOT NULL DEFAULT 0",
+	"CREATE TABLE IF NOT EXISTS `recovery_codes` (" +
+		"`id` INT NOT NULL AUTO_INCREMENT PRIMARY KEY," +
+		"`user_id` INT NOT NULL," +
+		"`code_hash` CHAR(64) NOT NULL," +
+		"`used_at` DATETIME NULL," +
+		"`created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"INDEX `idx_user_id_code_hash` (`user_id`, `code_hash`)" +
+		") DEFAULT CHARSET=utf8mb4",
+	"ALTER TABLE `users` ADD COLUMN `email` VARCHAR(255) NULL",
+	"CREATE TABLE IF NOT EXISTS `password_resets` (" +
+		"`id` INT NOT NULL AUTO_INCREMENT PRIMARY KEY," +
+		"`user_id` INT NOT NULL," +
+		"`token_hash` CHAR(64) NOT NULL," +
+		"`expires_at` DATETIME NOT NULL," +
+		"`used_at` DATETIME NULL," +
+		"`created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"UNIQUE KEY `uniq_token_hash` (`token_hash`)," +
+		"INDEX `idx_user_id` (`user_id`, `used_at`)" +
+		") DEFAULT CHARSET=utf8mb4",
+	"ALTER TABLE `users` ADD COLUMN `deletion_scheduled_at` DATETIME NULL",
+	"ALTER TABLE `users` ADD INDEX `idx_deletion_scheduled_at` (`deletion_scheduled_at`)",
+	"CREATE TABLE IF NOT EXISTS `user_sessions` (" +
+		"`id` INT NOT NULL AUTO_INCREMENT PRIMARY KEY," +
+		"`session_key` CHAR(32) NOT NULL," +
+		"`user_id` INT NOT NULL," +
+		"`user_agent` VARCHAR(255) NOT NULL," +
+		"`ip` VARCHAR(64) NOT NULL," +
+		"`created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"`last_seen_at` DATETIME NOT NULL," +
+		"`revoked_at` DATETIME NULL," +
+		"UNIQUE KEY `uniq_session_key` (`session_key`)," +
+		"INDEX `idx_user_id` (`user_id`, `revoked_at`)" +
+		") DEFAULT CHARSET=utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `user_identities` (" +
+		"`id` INT NOT NULL AUTO_INCREMENT PRIMARY KEY," +
+		"`user_id` INT NOT NULL," +
+		"`issuer` VARCHAR(255) NOT NULL," +
+		"`subject` VARCHAR(255) NOT NULL," +
+		"`email` VARCHAR(255) NOT NULL DEFAULT ''," +
+		"`created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"UNIQUE KEY `uniq_issuer_subject` (`issuer`, `subject`)," +
+		"UNIQUE KEY `uniq_user_issuer` (`user_id`, `issuer`)" +
+		") DEFAULT CHARSET=utf8mb4",
+	// ロールの変更でauthorityも書き換わるので、/initializeで戻せるよう初期データの値を控えておく
+	"ALTER TABLE `users` ADD COLUMN `seed_authority` TINYINT NULL",
+	"UPDATE `users` SET `seed_authority` = `authority` WHERE `seed_authority` IS NULL",
+}
+
+// ALTER TABLEにはIF NOT EXISTSが書けないので、適用済みのエラーは無視する
+func isAlreadyMigrated(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) {
+		return false
+	}
+	switch mysqlErr.Number {
+	case 1050, // テーブルが既に存在する
+		1060, // カラムが既に存在する
+		1061, // インデックスが既に存在する
+		1091: // 削除対象のカラムやインデックスが存在しない
+		return true
+	}
+	return false
+}
+
+func dbMigrate() {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS `schema_migrations` (" +
+		"`version` INT NOT NULL PRIMARY KEY," +
+		"`applied_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP" +
+		") DEFAULT CHARSET=utf8mb4")
+	if err != nil {
+		log.Fatalf("Failed to create schema_migrations: %s", err.Error())
+	}
+
+	applied := []int{}
+	err = db.Select(&applied, "SELECT `version` FROM `schema_migrations`")
+	if err != nil {
+		log.Fatalf("Failed to load schema_migrations: %s", err.Error())
+	}
+
+	for _, version := range pendingMigrations(applied) {
+		query := schemaMigrations[version-1]
+		_, err := db.Exec(query)
+		if err != nil && !isAlreadyMigrated(err) {
+			log.Fatalf("Failed to migrate schema: %s\nQuery: %s", err.Error(), query)
+		}
+		// 複数のプロセスが同時に起動しても記録は一つにする
+		_, err = db.Exec("INSERT IGNORE INTO `schema_migrations` (`version`) VALUES (?)", version)
+		if err != nil {
+			log.Fatalf("Failed to record schema version %d: %s", version, err.Error())
+		}
+	}
+}
+
+// まだ適用していないスキーマ変更のバージョンを順に返す。バージョンはschemaMigrationsの1始まりの位置
+func pendingMigrations(applied []int) []int {
+	done := make(map[int]bool, len(applied))
+	for _, v := range applied {
+		done[v] = true
+	}
+
+	pending := []int{}
+	for i := range schemaMigrations {
+		if !done[i+1] {
+			pending = append(pending, i+1)
+		}
+	}
+	return pending
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPendingMigrations(t *testing.T) {
+	orig := schemaMigrations
+	t.Cleanup(func() { schemaMigrations = orig })
+	schemaMigrations = []string{"a", "b", "c", "d"}
+
+	for _, tc := range []struct {
+		applied []int
+		want    []int
+	}{
+		{nil, []int{1, 2, 3, 4}},
+		{[]int{1, 2}, []int{3, 4}},
+		{[]int{1, 3}, []int{2, 4}},
+		{[]int{1, 2, 3, 4}, []int{}},
+	} {
+		if got := pendingMigrations(tc.applied); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("pendingMigrations(%v) = %v, want %v", tc.applied, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// CSPの違反を受け取るパス。ブラウザはトークンを付けずに送ってくるのでCSRFの確認から外す
+const cspReportPath = "/csp-report"
+
+// trueならCSPを適用せず、違反の報告だけを受け取る。ポリシーを厳しくするときにまずこれで様子を見る
+var cspReportOnly = os.Getenv("ISUCONP_CSP_REPORT_ONLY") == "1"
+
+// HSTSを有効にする期間(秒)。一度送るとその間はHTTPに戻せないので1年にしている
+const hstsMaxAge = "31536000"
+
+// テンプレートはインラインのscriptやstyleを使わないので、自分のオリジンのファイルだけを許可する
+// 画像はQRコードをdata URIで埋め込むのでdata:も許可する
+var contentSecurityPolicy = strings.Join([]string{
+	"default-src 'self'",
+	"script-src 'self'",
+	"style-src 'self'",
+	"img-src 'self' data:",
+	"connect-src 'self'",
+	"object-src 'none'",
+	"base-uri 'self'",
+	"form-action 'self'",
+	"frame-ancestors 'none'",
+	"report-uri " + cspReportPath,
+	"report-to csp-endpoint",
+}, "; ")
+
+// すべてのレスポンスにセキュリティ関連のヘッダーを付けるミドルウェア
+func securityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		if cspReportOnly {
+			h.Set("Content-Security-Policy-Report-Only", contentSecurityPolicy)
+		} else {
+			h.Set("Content-Security-Policy", contentSecurityPolicy)
+		}
+		h.Set("Reporting-Endpoints", `csp-endpoint="`+cspReportPath+`"`)
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("X-Frame-Options", "DENY")
+		h.Set("Referrer-Policy", "strict-origin-when-cross-origin")
+		if isTLS(r) {
+			h.Set("Strict-Transport-Security", "max-age="+hstsMaxAge+"; includeSubDomains")
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// TLSで受けたリクエストか。nginxでTLSを終端するときはX-Forwarded-Protoで判断する
+func isTLS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	return isFromLocalProxy(r) && r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+// 違反の報告は一つあたり数KBなので、それを超えるものは読まない
+const cspReportLimit = 64 * 1024
+
+type cspViolation struct {
+	DocumentURI       string `json:"document-uri"`
+	ViolatedDirective string `json:"violated-directive"`
+	BlockedURI        string `json:"blocked-uri"`
+	SourceFile        string `json:"source-file"`
+	LineNumber        int    `json:"line-number"`
+	Disposition       string `json:"disposition"`
+}
+
+// Reporting APIで送られてくる形式。キーの名前がreport-uriのものと違う
+type cspReportBody struct {
+	DocumentURL        string `json:"documentURL"`
+	EffectiveDirective string `json:"effectiveDirective"`
+	BlockedURL         string `json:"blockedURL"`
+	SourceFile         string `json:"sourceFile"`
+	LineNumber         int    `json:"lineNumber"`
+	Disposition        string `json:"disposition"`
+}
+
+// ブラウザから送られてくるCSPの違反をログに出す
+// report-uriは{"csp-report": {...}}を、Reporting APIは[{"type": "csp-violation", "body": {...}}]を送ってくる
+func postCSPReport(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, cspReportLimit))
+	if err != nil {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	violations := []cspViolation{}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/reports+json" {
+		reports := []struct {
+			Type string        `json:"type"`
+			Body cspReportBody `json:"body"`
+		}{}
+		if err := json.Unmarshal(body, &reports); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		for _, report := range reports {
+			if report.Type != "csp-violation" {
+				continue
+			}
+			violations = append(violations, cspViolation{
+				DocumentURI:       report.Body.DocumentURL,
+				ViolatedDirective: report.Body.EffectiveDirective,
+				BlockedURI:        report.Body.BlockedURL,
+				SourceFile:        report.Body.SourceFile,
+				LineNumber:        report.Body.LineNumber,
+				Disposition:       report.Body.Disposition,
+			})
+		}
+	} else {
+		report := struct {
+			CSPReport cspViolation `json:"csp-report"`
+		}{}
+		if err := json.Unmarshal(body, &report); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		violations = append(violations, report.CSPReport)
+	}
+
+	for _, v := range violations {
+		log.Printf("csp violation: document=%q directive=%q blocked=%q source=%q:%d disposition=%q",
+			v.DocumentURI, v.ViolatedDirective, v.BlockedURI, v.SourceFile, v.LineNumber, v.Disposition)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	h := securityHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	csp := w.Header().Get("Content-Security-Policy")
+	for _, directive := range []string{"script-src 'self'", "style-src 'self'", "object-src 'none'", "frame-ancestors 'none'"} {
+		if !strings.Contains(csp, directive+";") {
+			t.Errorf("CSP lacks %q: %s", directive, csp)
+		}
+	}
+	if strings.Contains(csp, "'unsafe-inline'") || strings.Contains(csp, "'nonce-") {
+		t.Errorf("CSP must not allow inline scripts: %s", csp)
+	}
+	if w.Header().Get("X-Frame-Options") != "DENY" || w.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Errorf("missing headers: %v", w.Header())
+	}
+	if w.Header().Get("Strict-Transport-Security") != "" {
+		t.Error("HSTS must not be sent over plain HTTP")
+	}
+
+	// ローカルのnginxがTLSを終端したときだけHSTSを付ける
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "127.0.0.1:12345"
+	r.Header.Set("X-Forwarded-Proto", "https")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Header().Get("Strict-Transport-Security") == "" {
+		t.Error("HSTS is missing behind a TLS-terminating proxy")
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "203.0.113.1:12345"
+	r.Header.Set("X-Forwarded-Proto", "https")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Header().Get("Strict-Transport-Security") != "" {
+		t.Error("X-Forwarded-Proto from a remote client must be ignored")
+	}
+}
+
+func TestPostCSPReport(t *testing.T) {
+	for _, tc := range []struct {
+		contentType, body string
+		want              int
+	}{
+		{"application/csp-report", `{"csp-report":{"document-uri":"http://example.com/","violated-directive":"script-src"}}`, http.StatusNoContent},
+		{"application/reports+json", `[{"type":"csp-violation","body":{"documentURL":"http://example.com/"}}]`, http.StatusNoContent},
+		{"application/csp-report", `not json`, http.StatusBadRequest},
+		{"application/csp-report", strings.Repeat("a", cspReportLimit+1), http.StatusRequestEntityTooLarge},
+	} {
+		r := httptest.NewRequest(http.MethodPost, cspReportPath, strings.NewReader(tc.body))
+		r.Header.Set("Content-Type", tc.contentType)
+		w := httptest.NewRecorder()
+		postCSPReport(w, r)
+		if w.Code != tc.want {
+			t.Errorf("%s %.40s: status %d, want %d", tc.contentType, tc.body, w.Code, tc.want)
+		}
+	}
+}
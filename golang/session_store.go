@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	gsm "github.com/bradleypeabody/gorilla-sessions-memcache"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// 設定がないときの値。以前はすべての環境でこの鍵を使っていたので、そのまま読めるよう残している
+const (
+	defaultSessionKey    = "sendagaya"
+	defaultSessionPrefix = "iscogram_"
+)
+
+// セッションの署名鍵を読み込む
+// ISUCONP_SESSION_KEYS(カンマ区切り)かISUCONP_SESSION_KEYS_FILE(1行に1つ、#から始まる行は無視)で指定する。
+// 先頭の鍵で署名し、残りの鍵は検証にだけ使うので、新しい鍵を先頭に足してから古い鍵を外せば
+// ログイン中のユーザーをログアウトさせずに鍵を入れ替えられる。
+// 「署名鍵:暗号鍵」と書くと、cookieの中身を暗号化もする。暗号鍵は16・24・32バイトのいずれか
+func loadSessionKeys() ([][]byte, error) {
+	entries := []string{}
+	if v := os.Getenv("ISUCONP_SESSION_KEYS"); v != "" {
+		entries = append(entries, strings.Split(v, ",")...)
+	}
+	if path := os.Getenv("ISUCONP_SESSION_KEYS_FILE"); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ISUCONP_SESSION_KEYS_FILE: %w", err)
+		}
+		for _, line := range strings.Split(string(b), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			entries = append(entries, line)
+		}
+	}
+
+	keyPairs := [][]byte{}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		hashKey, blockKey, _ := strings.Cut(entry, ":")
+		if hashKey == "" || strings.Contains(blockKey, ":") {
+			return nil, fmt.Errorf("session key must be \"hash\" or \"hash:block\": %q", entry)
+		}
+		switch len(blockKey) {
+		case 0, 16, 24, 32:
+		default:
+			return nil, fmt.Errorf("session block key must be 16, 24 or 32 bytes: got %d bytes", len(blockKey))
+		}
+		var block []byte
+		if blockKey != "" {
+			block = []byte(blockKey)
+		}
+		keyPairs = append(keyPairs, []byte(hashKey), block)
+	}
+
+	if len(keyPairs) == 0 {
+		log.Print("ISUCONP_SESSION_KEYS is not set; using the built-in session key")
+		keyPairs = append(keyPairs, []byte(defaultSessionKey), nil)
+	}
+	return keyPairs, nil
+}
+
+// cookieの属性。ISUCONP_COOKIE_*で変えられる
+// 既定ではHttpOnlyとSameSite=Laxを付け、HTTPSで配信するときはISUCONP_COOKIE_SECURE=1にする
+func loadSessionOptions() *sessions.Options {
+	opts := &sessions.Options{
+		Path:     "/",
+		MaxAge:   86400 * 30,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+
+	boolEnv := func(key string, dest *bool) {
+		v := os.Getenv(key)
+		if v == "" {
+			return
+		}
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("%s must be a boolean: %s", key, v)
+		}
+		*dest = b
+	}
+	boolEnv("ISUCONP_COOKIE_SECURE", &opts.Secure)
+	boolEnv("ISUCONP_COOKIE_HTTPONLY", &opts.HttpOnly)
+
+	if v := os.Getenv("ISUCONP_COOKIE_MAX_AGE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			log.Fatalf("ISUCONP_COOKIE_MAX_AGE must be a positive integer: %s", v)
+		}
+		opts.MaxAge = n
+	}
+
+	switch v := strings.ToLower(os.Getenv("ISUCONP_COOKIE_SAMESITE")); v {
+	case "", "lax":
+	case "strict":
+		opts.SameSite = http.SameSiteStrictMode
+	case "none":
+		// SameSite=NoneはSecureがないとブラウザに捨てられる
+		opts.SameSite = http.SameSiteNoneMode
+		opts.Secure = true
+	default:
+		log.Fatalf("ISUCONP_COOKIE_SAMESITE must be lax, strict or none: %s", v)
+	}
+
+	return opts
+}
+
+// memcachedは30日を超える期限をUNIX時刻として読むので、それより長いMaxAgeは時刻に直して渡す
+const memcacheMaxRelativeExpiration = 86400 * 30
+
+type sessionMemcacher struct {
+	gsm.Memcacher
+}
+
+func (m sessionMemcacher) Set(key, val string, flags, exp uint32, ocas uint64) (uint64, error) {
+	if exp > memcacheMaxRelativeExpiration {
+		exp += uint32(time.Now().Unix())
+	}
+	return m.Memcacher.Set(key, val, flags, exp, ocas)
+}
+
+// cookieの属性を設定し、署名の有効期限もMaxAgeに揃える
+// securecookieは既定で30日より古い署名を弾くので、揃えないとそれより長いMaxAgeが効かない
+func setSessionOptions(s *gsm.MemcacheStore, opts *sessions.Options) {
+	s.Options = opts
+	for _, c := range s.Codecs {
+		if codec, ok := c.(*securecookie.SecureCookie); ok {
+			codec.MaxAge(opts.MaxAge)
+		}
+	}
+}
+
+func newSessionStore() *gsm.MemcacheStore {
+	prefix := os.Getenv("ISUCONP_SESSION_PREFIX")
+	if prefix == "" {
+		prefix = defaultSessionPrefix
+	}
+
+	keyPairs, err := loadSessionKeys()
+	if err != nil {
+		log.Fatal(err)
+	}
+	s := gsm.NewMemcacherStore(sessionMemcacher{gsm.NewGoMemcacher(memcacheClient)}, prefix, keyPairs...)
+	setSessionOptions(s, loadSessionOptions())
+	return s
+}
+
+// cookieを消すときも、SecureやSameSiteは発行したときと同じにする
+func expiredSessionOptions() *sessions.Options {
+	opts := *store.Options
+	opts.MaxAge = -1
+	return &opts
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	gsm "github.com/bradleypeabody/gorilla-sessions-memcache"
+)
+
+// memcachedなしでセッションを使うための、メモリ上のMemcacher
+type memoryMemcacher struct {
+	mu     sync.Mutex
+	values map[string]string
+}
+
+func (m *memoryMemcacher) Get(key string) (string, uint32, uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	val, ok := m.values[key]
+	if !ok {
+		return "", 0, 0, errors.New("memoryMemcacher: cache miss")
+	}
+	return val, 0, 0, nil
+}
+
+func (m *memoryMemcacher) Set(key, val string, flags, exp uint32, ocas uint64) (uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.values[key] = val
+	return 0, nil
+}
+
+// テストの間だけ、セッションをメモリに保存する
+func useMemorySessionStore(t *testing.T) {
+	t.Helper()
+
+	orig := store
+	store = gsm.NewMemcacherStore(&memoryMemcacher{values: map[string]string{}}, defaultSessionPrefix, []byte("test"))
+	setSessionOptions(store, loadSessionOptions())
+	t.Cleanup(func() { store = orig })
+}
+
+// ブラウザのようにcookieを持ち回ってハンドラを呼ぶ
+type testBrowser struct {
+	cookies map[string]*http.Cookie
+}
+
+func newTestBrowser() *testBrowser {
+	return &testBrowser{cookies: map[string]*http.Cookie{}}
+}
+
+func (b *testBrowser) do(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	for _, c := range b.cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	for _, c := range w.Result().Cookies() {
+		b.cookies[c.Name] = c
+	}
+	return w
+}
+
+// 指定した鍵と属性でセッションストアを作る。backendを共有すれば、鍵だけを入れ替えたストアになる
+func newTestSessionStore(t *testing.T, backend gsm.Memcacher, keys string) *gsm.MemcacheStore {
+	t.Helper()
+
+	t.Setenv("ISUCONP_SESSION_KEYS", keys)
+	keyPairs, err := loadSessionKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := gsm.NewMemcacherStore(backend, defaultSessionPrefix, keyPairs...)
+	setSessionOptions(s, loadSessionOptions())
+	return s
+}
+
+// /loginでuser_idを保存し、/meでそれを返すハンドラ
+func sessionTestHandler(s *gsm.MemcacheStore) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		session, _ := s.Get(r, "isuconp-go.session")
+		session.Values["user_id"] = 1
+		if err := session.Save(r, w); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+	mux.HandleFunc("/me", func(w http.ResponseWriter, r *http.Request) {
+		session, err := s.Get(r, "isuconp-go.session")
+		if err != nil || session.IsNew {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, session.Values["user_id"])
+	})
+	return mux
+}
+
+func whoAmI(b *testBrowser, h http.Handler) string {
+	w := b.do(h, httptest.NewRequest(http.MethodGet, "/me", nil))
+	if w.Code != http.StatusOK {
+		return ""
+	}
+	return w.Body.String()
+}
+
+func TestSessionKeyRotation(t *testing.T) {
+	backend := &memoryMemcacher{values: map[string]string{}}
+	old := sessionTestHandler(newTestSessionStore(t, backend, "old-hash:0123456789abcdef"))
+	b := newTestBrowser()
+	b.do(old, httptest.NewRequest(http.MethodPost, "/login", nil))
+
+	// 新しい鍵を先頭に足しても、古い鍵で署名したcookieはそのまま読める
+	rotated := sessionTestHandler(newTestSessionStore(t, backend, "new-hash:fedcba9876543210,old-hash:0123456789abcdef"))
+	if got := whoAmI(b, rotated); got != "1" {
+		t.Fatalf("old cookie after rotation: user_id = %q", got)
+	}
+
+	// 古い鍵を外すと読めない
+	newOnly := sessionTestHandler(newTestSessionStore(t, backend, "new-hash:fedcba9876543210"))
+	if got := whoAmI(b, newOnly); got != "" {
+		t.Fatalf("old cookie without the old key: user_id = %q", got)
+	}
+
+	// 入れ替え中に発行したcookieは新しい鍵で署名されている
+	b = newTestBrowser()
+	b.do(rotated, httptest.NewRequest(http.MethodPost, "/login", nil))
+	if got := whoAmI(b, newOnly); got != "1" {
+		t.Fatalf("cookie issued during rotation: user_id = %q", got)
+	}
+}
+
+func TestLoadSessionKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	err := os.WriteFile(path, []byte("# 新しい鍵\nfile-new:0123456789abcdef01234567\n\n  file-old  \n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("ISUCONP_SESSION_KEYS", "env-new:0123456789abcdef0123456789abcdef, env-old")
+	t.Setenv("ISUCONP_SESSION_KEYS_FILE", path)
+
+	keyPairs, err := loadSessionKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"env-new", "0123456789abcdef0123456789abcdef",
+		"env-old", "",
+		"file-new", "0123456789abcdef01234567",
+		"file-old", "",
+	}
+	if len(keyPairs) != len(want) {
+		t.Fatalf("got %d keys, want %d", len(keyPairs), len(want))
+	}
+	for i, k := range keyPairs {
+		if string(k) != want[i] {
+			t.Errorf("key %d = %q, want %q", i, k, want[i])
+		}
+		// 暗号鍵がないときはnilにして、暗号化しない
+		if want[i] == "" && k != nil {
+			t.Errorf("key %d = %q, want nil", i, k)
+		}
+	}
+}
+
+func TestLoadSessionKeysDefault(t *testing.T) {
+	t.Setenv("ISUCONP_SESSION_KEYS", "")
+	t.Setenv("ISUCONP_SESSION_KEYS_FILE", "")
+
+	keyPairs, err := loadSessionKeys()
+	if err != nil || len(keyPairs) != 2 || string(keyPairs[0]) != defaultSessionKey || keyPairs[1] != nil {
+		t.Fatalf("keyPairs = %q, err = %v", keyPairs, err)
+	}
+}
+
+func TestLoadSessionKeysRejectsInvalid(t *testing.T) {
+	for _, keys := range []string{
+		"hash:short",
+		"hash:0123456789abcdef0",
+		":0123456789abcdef",
+		"hash:0123456789abcdef:extra",
+		"good,hash:short",
+	} {
+		t.Setenv("ISUCONP_SESSION_KEYS", keys)
+		if _, err := loadSessionKeys(); err == nil {
+			t.Errorf("%q must be rejected", keys)
+		}
+	}
+
+	t.Setenv("ISUCONP_SESSION_KEYS", "")
+	t.Setenv("ISUCONP_SESSION_KEYS_FILE", filepath.Join(t.TempDir(), "missing"))
+	if _, err := loadSessionKeys(); err == nil {
+		t.Error("a missing key file must be rejected")
+	}
+}
+
+func TestLoadSessionOptions(t *testing.T) {
+	for _, tc := range []struct {
+		env      map[string]string
+		secure   bool
+		httpOnly bool
+		sameSite http.SameSite
+		maxAge   int
+	}{
+		{map[string]string{}, false, true, http.SameSiteLaxMode, 86400 * 30},
+		{map[string]string{"ISUCONP_COOKIE_SECURE": "1", "ISUCONP_COOKIE_SAMESITE": "Strict"}, true, true, http.SameSiteStrictMode, 86400 * 30},
+		// SameSite=NoneのときはSecureを外せない
+		{map[string]string{"ISUCONP_COOKIE_SECURE": "0", "ISUCONP_COOKIE_SAMESITE": "none"}, true, true, http.SameSiteNoneMode, 86400 * 30},
+		{map[string]string{"ISUCONP_COOKIE_HTTPONLY": "false", "ISUCONP_COOKIE_MAX_AGE": "7776000"}, false, false, http.SameSiteLaxMode, 7776000},
+	} {
+		for _, key := range []string{"ISUCONP_COOKIE_SECURE", "ISUCONP_COOKIE_HTTPONLY", "ISUCONP_COOKIE_MAX_AGE", "ISUCONP_COOKIE_SAMESITE"} {
+			t.Setenv(key, tc.env[key])
+		}
+		opts := loadSessionOptions()
+		if opts.Secure != tc.secure || opts.HttpOnly != tc.httpOnly || opts.SameSite != tc.sameSite || opts.MaxAge != tc.maxAge {
+			t.Errorf("%v: options = %+v", tc.env, opts)
+		}
+	}
+}
+
+// 発行したcookieに、設定した属性が付いている
+func TestSessionCookieAttributes(t *testing.T) {
+	t.Setenv("ISUCONP_COOKIE_SAMESITE", "none")
+	t.Setenv("ISUCONP_COOKIE_MAX_AGE", "7776000")
+	h := sessionTestHandler(newTestSessionStore(t, &memoryMemcacher{values: map[string]string{}}, "hash"))
+
+	w := newTestBrowser().do(h, httptest.NewRequest(http.MethodPost, "/login", nil))
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("got %d cookies", len(cookies))
+	}
+	c := cookies[0]
+	if !c.Secure || !c.HttpOnly || c.SameSite != http.SameSiteNoneMode || c.MaxAge != 7776000 || c.Path != "/" {
+		t.Fatalf("cookie = %+v", c)
+	}
+}
+
+// 署名の有効期限もMaxAgeに従う
+func TestSessionCodecFollowsMaxAge(t *testing.T) {
+	t.Setenv("ISUCONP_COOKIE_MAX_AGE", "1")
+	h := sessionTestHandler(newTestSessionStore(t, &memoryMemcacher{values: map[string]string{}}, "hash"))
+	b := newTestBrowser()
+	b.do(h, httptest.NewRequest(http.MethodPost, "/login", nil))
+	if got := whoAmI(b, h); got != "1" {
+		t.Fatalf("user_id = %q", got)
+	}
+
+	// 署名の時刻は秒単位なので、2秒以上経てば確実に期限を過ぎる
+	time.Sleep(2100 * time.Millisecond)
+	if got := whoAmI(b, h); got != "" {
+		t.Fatalf("expired cookie was accepted: user_id = %q", got)
+	}
+}
+
+// 渡された期限を記録するMemcacher
+type expirationRecorder struct {
+	gsm.Memcacher
+	exp uint32
+}
+
+func (m *expirationRecorder) Set(key, val string, flags, exp uint32, ocas uint64) (uint64, error) {
+	m.exp = exp
+	return m.Memcacher.Set(key, val, flags, exp, ocas)
+}
+
+func TestSessionMemcacherExpiration(t *testing.T) {
+	rec := &expirationRecorder{Memcacher: &memoryMemcacher{values: map[string]string{}}}
+	m := sessionMemcacher{rec}
+
+	m.Set("short", "", 0, 3600, 0)
+	if rec.exp != 3600 {
+		t.Errorf("exp = %d, want 3600", rec.exp)
+	}
+
+	// 30日を超える期限は、UNIX時刻にして渡す
+	now := time.Now().Unix()
+	m.Set("long", "", 0, 7776000, 0)
+	if int64(rec.exp) < now+7776000 || int64(rec.exp) > now+7776000+5 {
+		t.Errorf("exp = %d, want about %d", rec.exp, now+7776000)
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"database/sql"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/gorilla/sessions"
+)
+
+// セッションの中身はmemcacheにあってユーザーごとに探せないので、
+// ログインしたセッションをuser_sessionsにも記録して一覧と無効化に使う
+type UserSession struct {
+	ID         int          `db:"id"`
+	SessionKey string       `db:"session_key"`
+	UserID     int          `db:"user_id"`
+	UserAgent  string       `db:"user_agent"`
+	IP         string       `db:"ip"`
+	CreatedAt  time.Time    `db:"created_at"`
+	LastSeenAt time.Time    `db:"last_seen_at"`
+	RevokedAt  sql.NullTime `db:"revoked_at"`
+}
+
+// セッションが有効かどうかをキャッシュしておく時間。last_seen_atもこの間隔で更新する
+const sessionStatusCacheTTL = 300
+
+func sessionStatusCacheKey(key string) string {
+	return "session_status:" + key
+}
+
+// ログイン済みのセッションにする
+func startLoginSession(w http.ResponseWriter, r *http.Request, userID interface{}) {
+	key := secureRandomStr(16)
+	userAgent := r.UserAgent()
+	if len(userAgent) > 255 {
+		userAgent = userAgent[:255]
+	}
+	_, err := db.Exec("INSERT INTO `user_sessions` (`session_key`, `user_id`, `user_agent`, `ip`, `last_seen_at`) VALUES (?,?,?,?,NOW())",
+		key, userID, userAgent, clientIP(r))
+	if err != nil {
+		log.Print(err)
+	}
+
+	session := getSession(r)
+	delete(session.Values, "pending_user_id")
+	delete(session.Values, "pending_at")
+	session.Values["user_id"] = userID
+	session.Values["session_key"] = key
+	session.Values["csrf_token"] = secureRandomStr(16)
+	session.Values["logged_in_at"] = time.Now().UnixNano()
+	session.Save(r, w)
+}
+
+// 一覧から無効にされたセッションかどうか
+// 記録を始める前からあるセッションにはキーがないので、まとめての無効化でだけ弾く
+func isRevokedSessionKey(session *sessions.Session, u User) bool {
+	key, ok := session.Values["session_key"].(string)
+	if !ok {
+		return false
+	}
+
+	item, err := memcacheClient.Get(sessionStatusCacheKey(key))
+	if err == nil {
+		return string(item.Value) != "active"
+	}
+	if err != memcache.ErrCacheMiss {
+		log.Print(err)
+		return false
+	}
+
+	s := UserSession{}
+	err = db.Get(&s, "SELECT * FROM `user_sessions` WHERE `session_key` = ?", key)
+	status := "active"
+	if err != nil || s.UserID != u.ID || s.RevokedAt.Valid {
+		status = "revoked"
+	} else {
+		_, err = db.Exec("UPDATE `user_sessions` SET `last_seen_at` = NOW() WHERE `id` = ?", s.ID)
+		if err != nil {
+			log.Print(err)
+		}
+	}
+
+	err = memcacheClient.Set(&memcache.Item{
+		Key:        sessionStatusCacheKey(key),
+		Value:      []byte(status),
+		Expiration: sessionStatusCacheTTL,
+	})
+	if err != nil {
+		log.Print(err)
+	}
+	return status != "active"
+}
+
+func revokeSession(s UserSession) error {
+	_, err := db.Exec("UPDATE `user_sessions` SET `revoked_at` = NOW() WHERE `id` = ? AND `revoked_at` IS NULL", s.ID)
+	if err != nil {
+		return err
+	}
+	err = memcacheClient.Delete(sessionStatusCacheKey(s.SessionKey))
+	if err != nil && err != memcache.ErrCacheMiss {
+		return err
+	}
+	return nil
+}
+
+// 無効にしたセッションが、キャッシュに残った状態で使われ続けないようにする
+func forgetSessionStatuses(keys []string) {
+	for _, key := range keys {
+		err := memcacheClient.Delete(sessionStatusCacheKey(key))
+		if err != nil && err != memcache.ErrCacheMiss {
+			log.Print(err)
+		}
+	}
+}
+
+// ユーザーのすべてのセッションを無効にする
+// 記録のない古いセッションもあるので、sessions_revoked_atも更新してgetSessionUserで弾く
+func revokeAllSessions(userID int) error {
+	now := time.Now()
+	sessionKeys := []string{}
+	err := db.Select(&sessionKeys, "SELECT `session_key` FROM `user_sessions` WHERE `user_id` = ? AND `revoked_at` IS NULL", userID)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE `user_sessions` SET `revoked_at` = ? WHERE `user_id` = ? AND `revoked_at` IS NULL", now, userID)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE `users` SET `sessions_revoked_at` = ? WHERE `id` = ?", now, userID)
+	if err != nil {
+		return err
+	}
+	invalidateUserCache(userID)
+	forgetSessionStatuses(sessionKeys)
+	return nil
+}
+
+// ログアウトしたセッションも一覧に残らないよう無効にする
+func revokeCurrentSession(r *http.Request) {
+	key, ok := getSession(r).Values["session_key"].(string)
+	if !ok {
+		return
+	}
+	s := UserSession{}
+	err := db.Get(&s, "SELECT * FROM `user_sessions` WHERE `session_key` = ?", key)
+	if err != nil {
+		return
+	}
+	if err := revokeSession(s); err != nil {
+		log.Print(err)
+	}
+}
+
+var (
+	sessionsTemplate = template.Must(template.ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("sessions.html")),
+	)
+)
+
+func getSessions(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	userSessions := []UserSession{}
+	err := db.Select(&userSessions,
+		"SELECT * FROM `user_sessions` WHERE `user_id` = ? AND `revoked_at` IS NULL ORDER BY `last_seen_at` DESC", me.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	current, _ := getSession(r).Values["session_key"].(string)
+
+	sessionsTemplate.Execute(w, struct {
+		Sessions   []UserSession
+		CurrentKey string
+		Me         User
+		CSRFToken  string
+		Flash      string
+	}{userSessions, current, me, getCSRFToken(r), getFlash(w, r, "notice")})
+}
+
+func postSessionRevoke(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	s := UserSession{}
+	err := db.Get(&s, "SELECT * FROM `user_sessions` WHERE `id` = ? AND `user_id` = ?", r.FormValue("id"), me.ID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if err := revokeSession(s); err != nil {
+		log.Print(err)
+		return
+	}
+
+	http.Redirect(w, r, "/settings/sessions", http.StatusFound)
+}
+
+// このセッションも含めてすべての端末からログアウトする
+func postSessionRevokeAll(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if err := revokeAllSessions(me.ID); err != nil {
+		log.Print(err)
+		return
+	}
+
+	session := getSession(r)
+	delete(session.Values, "user_id")
+	delete(session.Values, "session_key")
+	session.Values["notice"] = "すべての端末からログアウトしました"
+	session.Save(r, w)
+
+	http.Redirect(w, r, "/login", http.StatusFound)
+}
+
+// 管理者が指定したユーザーを強制的にログアウトさせる
+func postAdminLogout(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+
+	uid, err := strconv.Atoi(r.FormValue("uid"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	role := ""
+	err = db.Get(&role, "SELECT `role` FROM `users` WHERE `id` = ?", uid)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if !canForceLogout(me, role) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if err := revokeAllSessions(uid); err != nil {
+		log.Print(err)
+		return
+	}
+	recordModerationAction(me.ID, "logout", reportTargetUser, uid, 0)
+
+	http.Redirect(w, r, "/admin/banned", http.StatusFound)
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// ログイン失敗の数え方。直近windowの間の失敗がdelayAfterを超えると、
+// 超えた回数に応じて倍々に次の試行までの待ち時間を延ばし、lockoutAfterに達したらlockoutの間ロックする
+type loginThrottleRule struct {
+	prefix       string
+	window       time.Duration
+	delayAfter   int
+	maxDelay     time.Duration
+	lockoutAfter int
+	lockout      time.Duration
+}
+
+var (
+	accountLoginThrottle = loginThrottleRule{
+		prefix:       "login_attempts:account:",
+		window:       15 * time.Minute,
+		delayAfter:   3,
+		maxDelay:     time.Minute,
+		lockoutAfter: 10,
+		lockout:      15 * time.Minute,
+	}
+	// 同じIPから多くのユーザーがログインすることもあるので、アカウントより緩くする
+	ipLoginThrottle = loginThrottleRule{
+		prefix:       "login_attempts:ip:",
+		window:       15 * time.Minute,
+		delayAfter:   50,
+		maxDelay:     time.Minute,
+		lockoutAfter: 200,
+		lockout:      15 * time.Minute,
+	}
+)
+
+// memcacheのAddが競合したときにやり直す回数
+const loginThrottleRetries = 5
+
+// 直近windowの失敗を数えるために、windowをこの数の区間に分けて区間ごとに数える
+// 区間の幅だけ古い失敗が残ることがある
+const loginThrottleBuckets = 15
+
+// 入力されたアカウント名はmemcacheのキーに使えない文字を含みうるのでハッシュにする
+// 失敗の回数、待ち時間、ロックをそれぞれ別のキーに置く
+func (rule loginThrottleRule) cacheKey(id, kind string) string {
+	sum := sha256.Sum256([]byte(id))
+	return rule.prefix + kind + ":" + hex.EncodeToString(sum[:])
+}
+
+// failures回失敗したあと、次の試行までに空ける時間
+func (rule loginThrottleRule) delay(failures int) time.Duration {
+	if failures <= rule.delayAfter {
+		return 0
+	}
+	delay := time.Second
+	for i := rule.delayAfter + 1; i < failures && delay < rule.maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > rule.maxDelay {
+		delay = rule.maxDelay
+	}
+	return delay
+}
+
+func (rule loginThrottleRule) bucketWidth() time.Duration {
+	return rule.window / loginThrottleBuckets
+}
+
+// nowの属する区間から遡って、windowに含まれる区間の失敗の回数のキー。先頭がnowの区間
+func (rule loginThrottleRule) countKeys(id string, now time.Time) []string {
+	bucket := now.UnixNano() / int64(rule.bucketWidth())
+	keys := make([]string, 0, loginThrottleBuckets)
+	for i := int64(0); i < loginThrottleBuckets; i++ {
+		keys = append(keys, rule.cacheKey(id, "count:"+strconv.FormatInt(bucket-i, 10)))
+	}
+	return keys
+}
+
+// memcacheの有効期限は秒単位なので切り上げる
+func expirationSeconds(d time.Duration) int32 {
+	return int32((d + time.Second - 1) / time.Second)
+}
+
+// 期限の時刻を値に入れて、キーがまだなければ置く
+// すでにあれば置かずに、そこに入っている時刻を返す
+func addUntil(key string, until time.Time, d time.Duration) (time.Time, bool, error) {
+	err := memcacheClient.Add(&memcache.Item{
+		Key:        key,
+		Value:      []byte(strconv.FormatInt(until.UnixNano(), 10)),
+		Expiration: expirationSeconds(d),
+	})
+	if err == nil {
+		return until, true, nil
+	}
+	if err != memcache.ErrNotStored {
+		return time.Time{}, false, err
+	}
+
+	// 見に行く間に期限が切れていればゼロ値になる
+	existing, err := getUntil(key)
+	return existing, false, err
+}
+
+// nowの区間の失敗の回数を1増やし、直近windowの失敗の回数を返す
+// 前の区間はもう増えないので、増やしたあとの値に足しても同時に数えた試行どうしで同じ値にはならない
+func incrementFailures(rule loginThrottleRule, id string, now time.Time) (uint64, error) {
+	keys := rule.countKeys(id, now)
+	n, err := incrementCount(keys[0], rule.window+rule.bucketWidth())
+	if err != nil {
+		return 0, err
+	}
+
+	items, err := memcacheClient.GetMulti(keys[1:])
+	if err != nil {
+		return 0, err
+	}
+	for _, item := range items {
+		c, _ := strconv.ParseUint(string(item.Value), 10, 64)
+		n += c
+	}
+	return n, nil
+}
+
+func incrementCount(key string, d time.Duration) (uint64, error) {
+	for i := 0; i < loginThrottleRetries; i++ {
+		n, err := memcacheClient.Increment(key, 1)
+		if err != memcache.ErrCacheMiss {
+			return n, err
+		}
+		err = memcacheClient.Add(&memcache.Item{Key: key, Value: []byte("1"), Expiration: expirationSeconds(d)})
+		if err != memcache.ErrNotStored {
+			return 1, err
+		}
+		// 同時に最初の失敗を記録したリクエストがあったので、そちらの値を増やす
+	}
+	return 0, memcache.ErrNotStored
+}
+
+// 期限付きの時刻を置いたキーを読む。なければゼロ値
+func getUntil(key string) (time.Time, error) {
+	item, err := memcacheClient.Get(key)
+	if err == memcache.ErrCacheMiss {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	nano, _ := strconv.ParseInt(string(item.Value), 10, 64)
+	return time.Unix(0, nano), nil
+}
+
+// idのログインの試行を始める。試せないときは、次に試せる時刻を返す
+// 同時に届いたリクエストが揃って制限をすり抜けないよう、試行をあらかじめ失敗として数え、
+// 増やしたあとの値で判断する。成功したらreleaseLoginAttemptに同じnowを渡して取り消す
+func reserveLoginAttempt(rule loginThrottleRule, id string, now time.Time) (time.Time, error) {
+	// ロックは失敗の回数が減っても、期限までは解かない
+	lockedUntil, err := getUntil(rule.cacheKey(id, "lock"))
+	if err != nil {
+		return time.Time{}, err
+	}
+	if lockedUntil.After(now) {
+		return lockedUntil, nil
+	}
+
+	n, err := incrementFailures(rule, id, now)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	retryAt := time.Time{}
+	if int(n)-1 >= rule.lockoutAfter {
+		retryAt, _, err = addUntil(rule.cacheKey(id, "lock"), now.Add(rule.lockout), rule.lockout)
+	} else if delay := rule.delay(int(n)); delay > 0 {
+		// この試行が失敗したときの待ち時間を置いておく
+		// 前の試行の待ち時間が残っていれば置けないので、その間は試せない
+		var added bool
+		retryAt, added, err = addUntil(rule.cacheKey(id, "wait"), now.Add(delay), delay)
+		if added {
+			retryAt = time.Time{}
+		}
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !retryAt.After(now) {
+		return time.Time{}, nil
+	}
+
+	// 断った試行は失敗として数えない
+	_, err = memcacheClient.Decrement(rule.countKeys(id, now)[0], 1)
+	if err != nil && err != memcache.ErrCacheMiss {
+		return time.Time{}, err
+	}
+	return retryAt, nil
+}
+
+// reserveLoginAttemptで数えた試行が成功したので、失敗の数から除き、待ち時間も解く
+func releaseLoginAttempt(rule loginThrottleRule, id string, now time.Time) error {
+	_, err := memcacheClient.Decrement(rule.countKeys(id, now)[0], 1)
+	if err != nil && err != memcache.ErrCacheMiss {
+		return err
+	}
+	err = memcacheClient.Delete(rule.cacheKey(id, "wait"))
+	if err != nil && err != memcache.ErrCacheMiss {
+		return err
+	}
+	return nil
+}
+
+// 失敗の回数とロックを消す。ログインのたびに呼ぶので、回数は残っている区間だけを消す
+func clearLoginFailures(rule loginThrottleRule, id string) error {
+	items, err := memcacheClient.GetMulti(rule.countKeys(id, time.Now()))
+	if err != nil {
+		return err
+	}
+	keys := []string{rule.cacheKey(id, "wait"), rule.cacheKey(id, "lock")}
+	for key := range items {
+		keys = append(keys, key)
+	}
+	for _, key := range keys {
+		err := memcacheClient.Delete(key)
+		if err != nil && err != memcache.ErrCacheMiss {
+			return err
+		}
+	}
+	return nil
+}
+
+// nginxを経由したリクエストはX-Real-IPに元のIPが入っている
+// ヘッダは偽装できるので、ローカルのnginxから来たときだけ信用する
+func clientIP(r *http.Request) string {
+	if isFromLocalProxy(r) {
+		if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+			return realIP
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func isFromLocalProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// スロットリングで使うコマンドだけを実装した、テキストプロトコルのmemcached
+type memcachedStandIn struct {
+	mu      sync.Mutex
+	values  map[string][]byte
+	expires map[string]time.Time
+}
+
+func startMemcachedStandIn(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	m := &memcachedStandIn{values: map[string][]byte{}, expires: map[string]time.Time{}}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go m.serve(c)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// 期限が切れていれば消してからキーを探す。muを取ってから呼ぶ
+func (m *memcachedStandIn) lookup(key string) ([]byte, bool) {
+	if exp, ok := m.expires[key]; ok && !time.Now().Before(exp) {
+		delete(m.values, key)
+		delete(m.expires, key)
+	}
+	v, ok := m.values[key]
+	return v, ok
+}
+
+func (m *memcachedStandIn) serve(c net.Conn) {
+	defer c.Close()
+
+	rw := bufio.NewReadWriter(bufio.NewReader(c), bufio.NewWriter(c))
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		m.mu.Lock()
+		switch fields[0] {
+		case "gets":
+			for _, key := range fields[1:] {
+				if v, ok := m.lookup(key); ok {
+					fmt.Fprintf(rw, "VALUE %s 0 %d 1\r\n%s\r\n", key, len(v), v)
+				}
+			}
+			fmt.Fprint(rw, "END\r\n")
+		case "add", "set":
+			size, _ := strconv.Atoi(fields[4])
+			data := make([]byte, size+2)
+			if _, err := io.ReadFull(rw, data); err != nil {
+				m.mu.Unlock()
+				return
+			}
+			if _, ok := m.lookup(fields[1]); ok && fields[0] == "add" {
+				fmt.Fprint(rw, "NOT_STORED\r\n")
+				break
+			}
+			m.values[fields[1]] = data[:size]
+			delete(m.expires, fields[1])
+			if exp, _ := strconv.Atoi(fields[3]); exp > 0 {
+				m.expires[fields[1]] = time.Now().Add(time.Duration(exp) * time.Second)
+			}
+			fmt.Fprint(rw, "STORED\r\n")
+		case "incr", "decr":
+			v, ok := m.lookup(fields[1])
+			if !ok {
+				fmt.Fprint(rw, "NOT_FOUND\r\n")
+				break
+			}
+			n, _ := strconv.ParseUint(string(v), 10, 64)
+			delta, _ := strconv.ParseUint(fields[2], 10, 64)
+			if fields[0] == "incr" {
+				n += delta
+			} else if n > delta {
+				n -= delta
+			} else {
+				n = 0
+			}
+			m.values[fields[1]] = []byte(strconv.FormatUint(n, 10))
+			fmt.Fprintf(rw, "%d\r\n", n)
+		case "delete":
+			if _, ok := m.lookup(fields[1]); !ok {
+				fmt.Fprint(rw, "NOT_FOUND\r\n")
+				break
+			}
+			delete(m.values, fields[1])
+			delete(m.expires, fields[1])
+			fmt.Fprint(rw, "DELETED\r\n")
+		default:
+			fmt.Fprint(rw, "ERROR\r\n")
+		}
+		m.mu.Unlock()
+
+		if err := rw.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// テストの間だけ、memcacheClientの接続先を差し替える
+func useMemcachedStandIn(t *testing.T) {
+	t.Helper()
+
+	orig := memcacheClient
+	memcacheClient = memcache.New(startMemcachedStandIn(t))
+	memcacheClient.Timeout = time.Second
+	t.Cleanup(func() { memcacheClient = orig })
+}
+
+// 直近windowの失敗の回数
+func countFailures(t *testing.T, rule loginThrottleRule, id string, now time.Time) int {
+	t.Helper()
+
+	items, err := memcacheClient.GetMulti(rule.countKeys(id, now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, item := range items {
+		c, _ := strconv.Atoi(string(item.Value))
+		n += c
+	}
+	return n
+}
+
+// n個の試行を同時に始めて、受け付けられた数を返す
+func reserveConcurrently(t *testing.T, rule loginThrottleRule, id string, n int) int {
+	t.Helper()
+
+	var mu sync.Mutex
+	allowed := 0
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			retryAt, err := reserveLoginAttempt(rule, id, time.Now())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if retryAt.IsZero() {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return allowed
+}
+
+func TestReserveLoginAttemptLockout(t *testing.T) {
+	useMemcachedStandIn(t)
+	rule := loginThrottleRule{
+		prefix:       "test:",
+		window:       time.Minute,
+		delayAfter:   100,
+		maxDelay:     time.Minute,
+		lockoutAfter: 10,
+		lockout:      time.Minute,
+	}
+
+	// 同時に届いても、ロックまでに試せるのはlockoutAfter回だけ
+	if allowed := reserveConcurrently(t, rule, "mary", 30); allowed != rule.lockoutAfter {
+		t.Fatalf("allowed %d attempts, want %d", allowed, rule.lockoutAfter)
+	}
+
+	now := time.Now()
+	retryAt, err := reserveLoginAttempt(rule, "mary", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retryAt.Before(now.Add(rule.lockout - time.Second)) {
+		t.Fatalf("retryAt = %v, want about %v", retryAt, now.Add(rule.lockout))
+	}
+
+	// 他のアカウントには影響しない
+	if retryAt, err := reserveLoginAttempt(rule, "bob", now); err != nil || !retryAt.IsZero() {
+		t.Fatalf("another account: retryAt = %v, err = %v", retryAt, err)
+	}
+
+	if err := clearLoginFailures(rule, "mary"); err != nil {
+		t.Fatal(err)
+	}
+	if retryAt, err := reserveLoginAttempt(rule, "mary", now); err != nil || !retryAt.IsZero() {
+		t.Fatalf("after clear: retryAt = %v, err = %v", retryAt, err)
+	}
+}
+
+func TestReserveLoginAttemptDelay(t *testing.T) {
+	useMemcachedStandIn(t)
+	rule := loginThrottleRule{
+		prefix:       "test:",
+		window:       time.Minute,
+		delayAfter:   2,
+		maxDelay:     time.Minute,
+		lockoutAfter: 100,
+		lockout:      time.Minute,
+	}
+
+	for i := 0; i < rule.delayAfter+1; i++ {
+		if retryAt, err := reserveLoginAttempt(rule, "mary", time.Now()); err != nil || !retryAt.IsZero() {
+			t.Fatalf("attempt %d: retryAt = %v, err = %v", i+1, retryAt, err)
+		}
+	}
+
+	// delayAfterを超えて失敗したら、待ち時間の間は試せない
+	now := time.Now()
+	retryAt, err := reserveLoginAttempt(rule, "mary", now)
+	if err != nil || !retryAt.After(now) {
+		t.Fatalf("retryAt = %v, err = %v", retryAt, err)
+	}
+
+	// 待ち時間が明けたら、同時に届いても試せるのは一つだけ
+	// memcacheの期限はキーを置いた時刻から数えるので、少し余分に待つ
+	time.Sleep(time.Until(retryAt) + 100*time.Millisecond)
+	if allowed := reserveConcurrently(t, rule, "mary", 10); allowed != 1 {
+		t.Fatalf("allowed %d attempts after waiting, want 1", allowed)
+	}
+
+	// 断った試行は失敗として数えない
+	if n := countFailures(t, rule, "mary", time.Now()); n != rule.delayAfter+2 {
+		t.Fatalf("failure count = %d, want %d", n, rule.delayAfter+2)
+	}
+}
+
+// 失敗の回数が期限で消えても、ロックは期限まで解かない
+func TestReserveLoginAttemptLockOutlivesCount(t *testing.T) {
+	useMemcachedStandIn(t)
+	rule := loginThrottleRule{
+		prefix:       "test:",
+		window:       time.Minute,
+		delayAfter:   100,
+		maxDelay:     time.Minute,
+		lockoutAfter: 3,
+		lockout:      time.Hour,
+	}
+
+	now := time.Now()
+	for i := 0; i <= rule.lockoutAfter; i++ {
+		if _, err := reserveLoginAttempt(rule, "mary", now); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// windowが過ぎて、回数のキーがすべて期限切れになったところ
+	later := now.Add(2 * rule.window)
+	if n := countFailures(t, rule, "mary", later); n != 0 {
+		t.Fatalf("failure count after the window = %d", n)
+	}
+	retryAt, err := reserveLoginAttempt(rule, "mary", later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !retryAt.After(later) {
+		t.Fatalf("attempt allowed during the lockout: retryAt = %v", retryAt)
+	}
+}
+
+// 失敗は最初の失敗からではなく、直近windowの間で数える
+func TestLoginFailuresSlidingWindow(t *testing.T) {
+	useMemcachedStandIn(t)
+	rule := loginThrottleRule{
+		prefix:       "test:",
+		window:       15 * time.Minute,
+		delayAfter:   100,
+		maxDelay:     time.Minute,
+		lockoutAfter: 100,
+		lockout:      time.Minute,
+	}
+
+	start := time.Now()
+	for _, d := range []time.Duration{0, 5 * time.Minute, 10 * time.Minute} {
+		if _, err := reserveLoginAttempt(rule, "mary", start.Add(d)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		at   time.Duration
+		want int
+	}{
+		{10 * time.Minute, 3},
+		// 最初の失敗はwindowから外れても、残りは数え続ける
+		{16 * time.Minute, 2},
+		{21 * time.Minute, 1},
+		{26 * time.Minute, 0},
+	} {
+		if n := countFailures(t, rule, "mary", start.Add(tc.at)); n != tc.want {
+			t.Errorf("failures at +%v = %d, want %d", tc.at, n, tc.want)
+		}
+	}
+}
+
+func TestReleaseLoginAttempt(t *testing.T) {
+	useMemcachedStandIn(t)
+	rule := loginThrottleRule{
+		prefix:       "test:",
+		window:       time.Minute,
+		delayAfter:   2,
+		maxDelay:     time.Minute,
+		lockoutAfter: 3,
+		lockout:      time.Minute,
+	}
+
+	// 成功した試行は取り消すので、何度成功しても制限されない
+	for i := 0; i < 10; i++ {
+		now := time.Now()
+		retryAt, err := reserveLoginAttempt(rule, "mary", now)
+		if err != nil || !retryAt.IsZero() {
+			t.Fatalf("attempt %d: retryAt = %v, err = %v", i+1, retryAt, err)
+		}
+		if err := releaseLoginAttempt(rule, "mary", now); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLoginThrottleDelay(t *testing.T) {
+	rule := loginThrottleRule{delayAfter: 3, maxDelay: 10 * time.Second}
+	for _, tc := range []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{3, 0},
+		{4, time.Second},
+		{5, 2 * time.Second},
+		{6, 4 * time.Second},
+		{7, 8 * time.Second},
+		{8, 10 * time.Second},
+		{100, 10 * time.Second},
+	} {
+		if got := rule.delay(tc.failures); got != tc.want {
+			t.Errorf("delay(%d) = %v, want %v", tc.failures, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// RFC 6238の既定値。Google Authenticatorなど一般的なアプリはこの設定にしか対応していない
+const (
+	totpIssuer = "Iscogram"
+	totpPeriod = 30
+	totpDigits = 6
+	// 端末の時計のずれを考えて、前後1ステップ分のコードも受け付ける
+	totpSkew = 1
+	// パスワードを確認してから2段階目の入力までの猶予
+	totpLoginTimeout  = 5 * time.Minute
+	recoveryCodeCount = 10
+)
+
+// trueなら、権限を持つユーザーは2段階認証を設定するまで管理画面を使えない
+var require2FAForStaff = os.Getenv("ISUCONP_REQUIRE_2FA_FOR_STAFF") == "1"
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func generateTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+func totpCode(secret []byte, step int64) string {
+	mac := hmac.New(sha1.New, secret)
+	binary.Write(mac, binary.BigEndian, step)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// codeが合っていれば、そのコードのステップを返す
+func verifyTOTP(secret, code string, now time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func totpURI(accountName, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", totpIssuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + url.PathEscape(totpIssuer+":"+accountName) + "?" + v.Encode()
+}
+
+// 読み取り用のQRコードをdata URIで返す
+func totpQRCode(uri string) (template.URL, error) {
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		return "", err
+	}
+	return template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png)), nil
+}
+
+// 入力の揺れを吸収してからハッシュにする。コードそのものは保存しない
+func recoveryCodeHash(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// 新しいリカバリーコードを作り、以前のものは使えなくする
+func regenerateRecoveryCodes(userID int) ([]string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(b))
+		codes = append(codes, code[:4]+"-"+code[4:])
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM `recovery_codes` WHERE `user_id` = ?", userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, code := range codes {
+		_, err = tx.Exec("INSERT INTO `recovery_codes` (`user_id`, `code_hash`) VALUES (?,?)", userID, recoveryCodeHash(code))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// TOTPのコードかリカバリーコードで2段階目を確認する
+// 同じコードを二度使えないよう、TOTPは使ったステップを、リカバリーコードは使った時刻を条件付きで記録する
+func verifySecondFactor(u User, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	if step, ok := verifyTOTP(u.TOTPSecret.String, code, time.Now()); ok {
+		result, err := db.Exec("UPDATE `users` SET `totp_last_step` = ? WHERE `id` = ? AND `totp_last_step` < ?", step, u.ID, step)
+		if err != nil {
+			return false, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return false, err
+		}
+		return n == 1, nil
+	}
+
+	result, err := db.Exec("UPDATE `recovery_codes` SET `used_at` = NOW() WHERE `user_id` = ? AND `code_hash` = ? AND `used_at` IS NULL",
+		u.ID, recoveryCodeHash(code))
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+func (u User) HasTOTP() bool {
+	return u.TOTPSecret.Valid
+}
+
+// パスワードの確認が済んで、2段階目を待っているユーザー
+func getPendingLoginUser(r *http.Request) (User, bool) {
+	session := getSession(r)
+	uid, ok := session.Values["pending_user_id"].(int)
+	if !ok {
+		return User{}, false
+	}
+	at, _ := session.Values["pending_at"].(int64)
+	if time.Since(time.Unix(0, at)) > totpLoginTimeout {
+		return User{}, false
+	}
+
+	u := User{}
+	err := db.Get(&u, "SELECT * FROM `users` WHERE `id` = ? AND `del_flg` = 0", uid)
+	if err != nil || !u.HasTOTP() {
+		return User{}, false
+	}
+	return u, true
+}
+
+var (
+	loginTwoFactorTemplate = template.Must(template.ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("login_2fa.html")),
+	)
+)
+
+func getLoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	if _, ok := getPendingLoginUser(r); !ok {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	csrfToken := issueCSRFToken(w, r)
+	loginTwoFactorTemplate.Execute(w, struct {
+		Me        User
+		Flash     string
+		CSRFToken string
+	}{User{}, getFlash(w, r, "notice"), csrfToken})
+}
+
+func postLoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	u, ok := getPendingLoginUser(r)
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	// コードの総当たりもパスワードと同じ制限で防ぐ
+	now := time.Now()
+	retryAt, err := reserveLoginAttempt(accountLoginThrottle, u.AccountName, now)
+	if err != nil {
+		log.Print(err)
+	}
+	if !retryAt.IsZero() {
+		session := getSession(r)
+		session.Values["notice"] = "試行回数が多すぎます。" + retryAt.Format("15:04:05") + "以降に再度お試しください"
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/login/2fa", http.StatusFound)
+		return
+	}
+
+	ok, err = verifySecondFactor(u, r.FormValue("code"))
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	if !ok {
+		// 試行は失敗として数えてあるので、そのまま残す
+		session := getSession(r)
+		session.Values["notice"] = "確認コードが間違っています"
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/login/2fa", http.StatusFound)
+		return
+	}
+
+	if err := clearLoginFailures(accountLoginThrottle, u.AccountName); err != nil {
+		log.Print(err)
+	}
+	startLoginSession(w, r, u.ID)
+	if cancelAccountDeletion(u) {
+		session := getSession(r)
+		session.Values["notice"] = "アカウントの削除を取り消しました"
+		session.Save(r, w)
+	}
+
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+var (
+	twoFactorSettingsTemplate = template.Must(template.ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("two_factor.html")),
+	)
+)
+
+type twoFactorSettings struct {
+	Me            User
+	CSRFToken     string
+	Flash         string
+	Secret        string
+	URI           string
+	QRCode        template.URL
+	RecoveryCodes []string
+	RemainingCode int
+	Required      bool
+}
+
+func renderTwoFactorSettings(w http.ResponseWriter, r *http.Request, me User, recoveryCodes []string) {
+	data := twoFactorSettings{
+		Me:            me,
+		CSRFToken:     getCSRFToken(r),
+		Flash:         getFlash(w, r, "notice"),
+		RecoveryCodes: recoveryCodes,
+		Required:      require2FAForStaff && me.IsStaff(),
+	}
+
+	if me.HasTOTP() {
+		err := db.Get(&data.RemainingCode, "SELECT COUNT(*) FROM `recovery_codes` WHERE `user_id` = ? AND `used_at` IS NULL", me.ID)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+	} else {
+		// 確認コードが正しく入力されるまでは、秘密鍵はセッションにだけ置いておく
+		session := getSession(r)
+		secret, ok := session.Values["totp_pending_secret"].(string)
+		if !ok {
+			var err error
+			secret, err = generateTOTPSecret()
+			if err != nil {
+				log.Print(err)
+				return
+			}
+			session.Values["totp_pending_secret"] = secret
+			session.Save(r, w)
+		}
+
+		data.Secret = secret
+		data.URI = totpURI(me.AccountName, secret)
+		qr, err := totpQRCode(data.URI)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		data.QRCode = qr
+	}
+
+	twoFactorSettingsTemplate.Execute(w, data)
+}
+
+func getTwoFactorSettings(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	renderTwoFactorSettings(w, r, me, nil)
+}
+
+func redirectTwoFactorSettings(w http.ResponseWriter, r *http.Request, notice string) {
+	session := getSession(r)
+	session.Values["notice"] = notice
+	session.Save(r, w)
+
+	http.Redirect(w, r, "/settings/2fa", http.StatusFound)
+}
+
+func postTwoFactorEnable(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	session := getSession(r)
+	secret, ok := session.Values["totp_pending_secret"].(string)
+	if me.HasTOTP() || !ok {
+		http.Redirect(w, r, "/settings/2fa", http.StatusFound)
+		return
+	}
+
+	step, ok := verifyTOTP(secret, strings.TrimSpace(r.FormValue("code")), time.Now())
+	if !ok {
+		redirectTwoFactorSettings(w, r, "確認コードが間違っています")
+		return
+	}
+
+	_, err := db.Exec("UPDATE `users` SET `totp_secret` = ?, `totp_last_step` = ? WHERE `id` = ? AND `totp_secret` IS NULL", secret, step, me.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	invalidateUserCache(me.ID)
+
+	codes, err := regenerateRecoveryCodes(me.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	delete(session.Values, "totp_pending_secret")
+	session.Save(r, w)
+
+	me.TOTPSecret = sql.NullString{String: secret, Valid: true}
+	renderTwoFactorSettings(w, r, me, codes)
+}
+
+// 無効化やリカバリーコードの再発行は、その時点のコードを確認してから行う
+func verifyTwoFactorForm(w http.ResponseWriter, r *http.Request) (User, bool) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return User{}, false
+	}
+
+	if !me.HasTOTP() {
+		http.Redirect(w, r, "/settings/2fa", http.StatusFound)
+		return User{}, false
+	}
+
+	ok, err := verifySecondFactor(me, r.FormValue("code"))
+	if err != nil {
+		log.Print(err)
+		return User{}, false
+	}
+	if !ok {
+		redirectTwoFactorSettings(w, r, "確認コードが間違っています")
+		return User{}, false
+	}
+
+	return me, true
+}
+
+func postTwoFactorDisable(w http.ResponseWriter, r *http.Request) {
+	me, ok := verifyTwoFactorForm(w, r)
+	if !ok {
+		return
+	}
+
+	if require2FAForStaff && me.IsStaff() {
+		redirectTwoFactorSettings(w, r, "管理権限を持つユーザーは2段階認証を無効にできません")
+		return
+	}
+
+	_, err := db.Exec("UPDATE `users` SET `totp_secret` = NULL WHERE `id` = ?", me.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	_, err = db.Exec("DELETE FROM `recovery_codes` WHERE `user_id` = ?", me.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	invalidateUserCache(me.ID)
+
+	redirectTwoFactorSettings(w, r, "2段階認証を無効にしました")
+}
+
+func postTwoFactorRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	me, ok := verifyTwoFactorForm(w, r)
+	if !ok {
+		return
+	}
+
+	codes, err := regenerateRecoveryCodes(me.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	renderTwoFactorSettings(w, r, me, codes)
+}
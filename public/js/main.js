@@ -23,6 +23,144 @@ timeago.register('ja', (number, index) => {
 document.addEventListener('DOMContentLoaded', () => {
   timeago.render(document.querySelectorAll('time.timeago'), 'ja');
 
+  // 複数画像の投稿。SSEで後から差し込まれた投稿でも動くようにdocumentで受ける
+  document.addEventListener('click', (e) => {
+    const step = e.target.classList.contains('isu-carousel-next') ? 1 :
+      e.target.classList.contains('isu-carousel-prev') ? -1 : 0;
+    if (step === 0) {
+      return;
+    }
+    const carousel = e.target.closest('.isu-carousel');
+    const images = carousel.querySelectorAll('.isu-image');
+    const index = (parseInt(carousel.dataset.index, 10) + step + images.length) % images.length;
+    images.forEach((img, i) => img.classList.toggle('isu-image-hidden', i !== index));
+    carousel.dataset.index = index;
+    carousel.querySelector('.isu-carousel-position').textContent = index + 1;
+  });
+
+  document.querySelectorAll('.isu-comment-more').forEach((commentMore) => {
+    const commentBtn = commentMore.querySelector('.isu-comment-more-btn');
+    const postId = commentMore.dataset.postId;
+
+    commentBtn.addEventListener('click', () => {
+      commentMore.classList.add('loading');
+      const maxCreatedAt = commentMore.dataset.maxCreatedAt;
+      const maxId = commentMore.dataset.maxId;
+      fetch(`/posts/${postId}/comments?max_created_at=${encodeURIComponent(maxCreatedAt)}&max_id=${maxId}`, {
+        method: 'GET',
+      }).then(response => {
+        if (!response.ok) {
+          throw new Error('Network response was not ok');
+        }
+        return response.text();
+      }).then(text => {
+        const parser = new DOMParser();
+        const doc = parser.parseFromString(text, "text/html");
+        const comments = doc.querySelector('.isu-comments');
+        // 読んだコメントは、いま表示しているものより古いので先頭に入れる
+        const firstEl = commentMore.nextSibling;
+        comments.querySelectorAll(':scope > .isu-comment').forEach((el) => {
+          const id = el.getAttribute('id');
+          if (!document.getElementById(id)) {
+            commentMore.parentElement.insertBefore(el, firstEl);
+          }
+        });
+        commentMore.classList.remove('loading');
+        // 続きの位置が返ってこなければ、もう古いコメントはない
+        if (comments.dataset.maxId) {
+          commentMore.dataset.maxCreatedAt = comments.dataset.maxCreatedAt;
+          commentMore.dataset.maxId = comments.dataset.maxId;
+        } else {
+          commentMore.remove();
+        }
+      }).catch(() => {
+        commentMore.remove();
+      });
+    });
+  });
+
+  // 「以前のコメントを見る」で読んだコメントにもボタンがあるので、documentで受ける
+  document.addEventListener('click', (e) => {
+    const replyBtn = e.target.closest('.isu-reply-more-btn');
+    if (!replyBtn) {
+      return;
+    }
+    const replyMore = replyBtn.closest('.isu-reply-more');
+    if (replyMore.classList.contains('loading')) {
+      return;
+    }
+    replyMore.classList.add('loading');
+    const commentId = replyMore.dataset.commentId;
+    const maxCreatedAt = replyMore.dataset.maxCreatedAt;
+    const maxId = replyMore.dataset.maxId;
+    fetch(`/comments/${commentId}/replies?max_created_at=${encodeURIComponent(maxCreatedAt)}&max_id=${maxId}`, {
+      method: 'GET',
+    }).then(response => {
+      if (!response.ok) {
+        throw new Error('Network response was not ok');
+      }
+      return response.text();
+    }).then(text => {
+      const parser = new DOMParser();
+      const doc = parser.parseFromString(text, "text/html");
+      const replies = doc.querySelector('.isu-comment-replies');
+      // 読んだ返信は、いま表示しているものより古いので先頭に入れる
+      const firstEl = replyMore.nextSibling;
+      replies.querySelectorAll(':scope > .isu-comment-reply').forEach((el) => {
+        if (!document.getElementById(el.getAttribute('id'))) {
+          replyMore.parentElement.insertBefore(el, firstEl);
+        }
+      });
+      replyMore.classList.remove('loading');
+      if (replies.dataset.maxId) {
+        replyMore.dataset.maxCreatedAt = replies.dataset.maxCreatedAt;
+        replyMore.dataset.maxId = replies.dataset.maxId;
+      } else {
+        replyMore.remove();
+      }
+    }).catch(() => {
+      replyMore.remove();
+    });
+  });
+
+  if (window.EventSource && document.querySelector('.isu-posts, .isu-post')) {
+    const parser = new DOMParser();
+    const parseFragment = (html) => parser.parseFromString(html, "text/html").body.firstElementChild;
+    const events = new EventSource('/events');
+
+    // 新しい投稿はタイムライン(トップページ)にだけ差し込む
+    events.addEventListener('post', (e) => {
+      const data = JSON.parse(e.data);
+      const posts = document.querySelector('.isu-posts');
+      if (!posts || !document.getElementById('isu-post-more') || document.getElementById(`pid_${data.post_id}`)) {
+        return;
+      }
+      posts.prepend(parseFragment(data.html));
+      timeago.render(document.querySelectorAll('time.timeago'), 'ja');
+    });
+
+    events.addEventListener('comment', (e) => {
+      const data = JSON.parse(e.data);
+      const postEl = document.getElementById(`pid_${data.post_id}`);
+      if (!postEl || document.getElementById(`cid_${data.comment_id}`)) {
+        return;
+      }
+      const el = parseFragment(data.html);
+      if (data.parent_id) {
+        const parentEl = document.getElementById(`cid_${data.parent_id}`);
+        if (!parentEl) {
+          return;
+        }
+        parentEl.querySelector('.isu-comment-replies').append(el);
+      } else {
+        const form = postEl.querySelector('.isu-comment-form');
+        form.parentElement.insertBefore(el, form);
+      }
+      const count = postEl.querySelector('.isu-post-comment-count b');
+      count.textContent = parseInt(count.textContent, 10) + 1;
+    });
+  }
+
   const btn = document.getElementById('isu-post-more-btn');
   const postMore = document.getElementById('isu-post-more');
 